@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// aggregate is a running count over the comments a stream sends.
+type aggregate struct {
+	name string
+	keys func(c Comment) []string // what the comment counts towards
+}
+
+// parseAggregates reads ?aggregate=commentsPerUser,commentsPerPost. Comments
+// are matched to posts as of snap.
+func parseAggregates(value string, snap *snapshot) ([]aggregate, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var aggs []aggregate
+	for _, name := range strings.Split(value, ",") {
+		switch name {
+		case "commentsPerUser":
+			aggs = append(aggs, aggregate{name: name, keys: func(c Comment) []string { return []string{c.User} }})
+		case "commentsPerPost":
+			posts := make(map[string][]string)
+			for _, p := range snap.Posts() {
+				for _, cid := range p.Comments {
+					posts[cid] = append(posts[cid], p.ID)
+				}
+			}
+			aggs = append(aggs, aggregate{name: name, keys: func(c Comment) []string { return posts[c.ID] }})
+		default:
+			return nil, fmt.Errorf("invalid aggregate %q, want commentsPerUser or commentsPerPost", name)
+		}
+	}
+	return aggs, nil
+}
+
+// countComments returns a FlatMap function that follows every batch of
+// comments with an aggregate part, e.g.
+// {"type":"aggregate","commentsPerUser":{"u1":2}}, holding the new counts of
+// the keys the batch changed. Merging the aggregate parts of a stream gives
+// the counts over all the comments it sent.
+func countComments(aggs []aggregate) func(Item[[]Item[any]]) []Item[[]Item[any]] {
+	counts := make([]map[string]int, len(aggs))
+	for i := range counts {
+		counts[i] = make(map[string]int)
+	}
+	return func(batch Item[[]Item[any]]) []Item[[]Item[any]] {
+		part := map[string]any{"type": "aggregate"}
+		for i, agg := range aggs {
+			changed := make(map[string]int)
+			for _, it := range batch.Value {
+				c, ok := commentOf(it)
+				if !ok {
+					continue
+				}
+				for _, key := range agg.keys(c) {
+					counts[i][key]++
+					changed[key] = counts[i][key]
+				}
+			}
+			if len(changed) > 0 {
+				part[agg.name] = changed
+			}
+		}
+		if len(part) == 1 {
+			return []Item[[]Item[any]]{batch}
+		}
+		return []Item[[]Item[any]]{batch, {Type: "aggregate", Value: []Item[any]{{Type: "aggregate", Value: part}}}}
+	}
+}
+
+// commentOf returns the comment an item carries, decoding it if it came from
+// an upstream.
+func commentOf(it Item[any]) (Comment, bool) {
+	if it.ID == "" {
+		return Comment{}, false
+	}
+	switch v := it.Value.(type) {
+	case Comment:
+		return v, true
+	case json.RawMessage:
+		var c Comment
+		err := json.Unmarshal(v, &c)
+		return c, err == nil
+	}
+	return Comment{}, false
+}
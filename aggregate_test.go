@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/M0rfes/multipart-mixed/client"
+)
+
+func TestAggregateRejectedWithLive(t *testing.T) {
+	w := httptest.NewRecorder()
+	streamHandler(w, httptest.NewRequest("GET", "/stream?live=1&aggregate=commentsPerUser", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// Merging the aggregate parts of a stream gives the counts over all of its
+// comments, however they are batched.
+func TestAggregateCounts(t *testing.T) {
+	savedDB, savedLatency, savedPolicy := db, emitLatency, batchPolicies["comment"]
+	db, emitLatency = newStore(posts, comments, users), time.Millisecond
+	defer func() { db, emitLatency, batchPolicies["comment"] = savedDB, savedLatency, savedPolicy }()
+	srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer srv.Close()
+
+	snap := db.snapshot()
+	perUser := make(map[string]any)
+	perPost := make(map[string]any)
+	for _, c := range snap.Comments() {
+		perUser[c.User] = count(perUser[c.User]) + 1
+	}
+	for _, p := range snap.Posts() {
+		for _, cid := range p.Comments {
+			for _, c := range snap.Comments() {
+				if c.ID == cid {
+					perPost[p.ID] = count(perPost[p.ID]) + 1
+				}
+			}
+		}
+	}
+	if len(snap.Comments())%3 == 0 {
+		t.Fatalf("%d comments split evenly into batches of 3", len(snap.Comments()))
+	}
+
+	// Batches of 3 leave an odd one at the end.
+	for _, items := range []int{1, 2, 3} {
+		batchPolicies["comment"] = batchPolicy{maxItems: items}
+		resp, err := http.Get(srv.URL + "/stream?aggregate=commentsPerUser,commentsPerPost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		entities := make(client.Entities)
+		err = entities.ReadStream(resp)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := entities["aggregate/commentsPerUser"]; !reflect.DeepEqual(got, perUser) {
+			t.Errorf("batches of %d: commentsPerUser = %v, want %v", items, got, perUser)
+		}
+		if got := entities["aggregate/commentsPerPost"]; !reflect.DeepEqual(got, perPost) {
+			t.Errorf("batches of %d: commentsPerPost = %v, want %v", items, got, perPost)
+		}
+	}
+}
+
+// count reads a count as a client decodes it.
+func count(v any) float64 {
+	n, _ := v.(float64)
+	return n
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// errSlowClient cancels a stream whose client does not keep up.
+var errSlowClient = errors.New("client too slow")
+
+// Counters published at /debug/vars.
+var (
+	droppedParts      = expvar.NewInt("stream_dropped_parts")
+	slowClientAborts  = expvar.NewInt("stream_slow_client_disconnects")
+	streamWriteErrors = expvar.NewInt("stream_write_errors")
+)
+
+// writeTimeout bounds how long writing a single part may take.
+var writeTimeout = 10 * time.Second
+
+type overflowPolicy string
+
+const (
+	overflowBlock      overflowPolicy = "block"
+	overflowDropOldest overflowPolicy = "drop-oldest"
+	overflowDisconnect overflowPolicy = "disconnect"
+)
+
+func (p *overflowPolicy) String() string { return string(*p) }
+
+func (p *overflowPolicy) Set(value string) error {
+	switch overflowPolicy(value) {
+	case overflowBlock, overflowDropOldest, overflowDisconnect:
+		*p = overflowPolicy(value)
+		return nil
+	}
+	return fmt.Errorf("invalid overflow policy %q, want block, drop-oldest or disconnect", value)
+}
+
+// bufferPolicy bounds the parts a stream buffers per source while its client
+// is slower than the sources.
+type bufferPolicy struct {
+	size     int
+	overflow overflowPolicy
+}
+
+var streamBuffer = bufferPolicy{size: 16, overflow: overflowBlock}
+
+// setSize parses -stream-buffer. A buffer must hold at least one part, or no
+// part could ever be queued.
+func (p *bufferPolicy) setSize(value string) error {
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 1 {
+		return fmt.Errorf("invalid stream buffer %q, want 1 or more", value)
+	}
+	p.size = size
+	return nil
+}
+
+// abortSlowClient logs why a stream ended early and, if the client could not
+// keep up, drops the connection instead of ending the response normally, so
+// the client cannot mistake the truncated stream for a complete one.
+func abortSlowClient(r *http.Request, cause error) {
+	switch {
+	case errors.Is(cause, errSlowClient):
+		slowClientAborts.Add(1)
+	case errors.Is(cause, r.Context().Err()):
+		return // the client went away by itself
+	default:
+		streamWriteErrors.Add(1)
+	}
+	fmt.Printf("Disconnecting %s from %s: %v\n", r.RemoteAddr, r.URL.Path, cause)
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestBufferPolicySetSize(t *testing.T) {
+	var p bufferPolicy
+	if err := p.setSize("4"); err != nil || p.size != 4 {
+		t.Errorf("setSize(4): size %d, %v", p.size, err)
+	}
+	for _, value := range []string{"0", "-1", "x"} {
+		if err := p.setSize(value); err == nil {
+			t.Errorf("setSize(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	maxBatchParts       = 100
+	maxBatchConcurrency = 16
+)
+
+// batchRecorder buffers a sub-response. Flush is a no-op so streaming handlers
+// can run inside a batch; their output is sent once they finish.
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *batchRecorder) Header() http.Header { return rec.header }
+
+func (rec *batchRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *batchRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	return rec.body.Write(b)
+}
+
+func (rec *batchRecorder) Flush() {}
+
+// batchHandler serves POST /batch. The request body is multipart/mixed with one
+// application/http part per sub-request; each is run against h concurrently
+// and its response is streamed back as soon as it completes, with the
+// Content-ID of the request prefixed by "response-".
+func batchHandler(h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/mixed" || params["boundary"] == "" {
+			http.Error(w, "batch requests must be multipart/mixed with a boundary", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// Sub-responses may be multipart themselves, so use a boundary they
+		// cannot contain.
+		pw, ok := newPartWriterBoundary(w, r, randomBoundary())
+		if !ok {
+			return
+		}
+
+		sem := make(chan struct{}, maxBatchConcurrency)
+		var wg sync.WaitGroup
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		for n := 1; ; n++ {
+			part, err := reader.NextPart()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				sendBatchError(pw, err)
+				break
+			}
+			if n > maxBatchParts {
+				sendBatchError(pw, fmt.Errorf("batch has more than %d parts", maxBatchParts))
+				break
+			}
+
+			contentID := strings.Trim(part.Header.Get("Content-ID"), "<>")
+			if contentID == "" {
+				contentID = fmt.Sprint(n)
+			}
+			sub, err := readBatchRequest(part)
+			if err != nil {
+				sendBatchResponse(pw, contentID, errorRecorder(http.StatusBadRequest, err.Error()))
+				continue
+			}
+			sub = sub.WithContext(r.Context())
+			sub.RemoteAddr = r.RemoteAddr
+
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				rec := &batchRecorder{header: make(http.Header)}
+				h.ServeHTTP(rec, sub)
+				sendBatchResponse(pw, contentID, rec)
+			}()
+		}
+		wg.Wait()
+		if r.Context().Err() != nil {
+			return
+		}
+		pw.close()
+	}
+}
+
+// readBatchRequest parses an embedded request and buffers its body, since the
+// next part cannot be read until this one is consumed.
+func readBatchRequest(part *multipart.Part) (*http.Request, error) {
+	if ct := part.Header.Get("Content-Type"); ct != "application/http" {
+		return nil, fmt.Errorf("part has Content-Type %q, want application/http", ct)
+	}
+	req, err := http.ReadRequest(bufio.NewReader(part))
+	if err != nil {
+		return nil, fmt.Errorf("invalid embedded request: %w", err)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid embedded request body: %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if req.URL.Path == "/batch" {
+		return nil, errors.New("batch requests cannot be nested")
+	}
+	return req, nil
+}
+
+func errorRecorder(status int, msg string) *batchRecorder {
+	rec := &batchRecorder{header: make(http.Header)}
+	http.Error(rec, msg, status)
+	return rec
+}
+
+func sendBatchResponse(pw *partWriter, contentID string, rec *batchRecorder) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	resp := &http.Response{
+		StatusCode:    rec.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.header,
+		Body:          io.NopCloser(&rec.body),
+		ContentLength: int64(rec.body.Len()),
+	}
+	resp.Header.Del("Transfer-Encoding")
+	var buf bytes.Buffer
+	if err := resp.Write(&buf); err != nil {
+		fmt.Println("Error writing batch response:", err)
+		return
+	}
+	pw.writePart(http.Header{
+		"Content-Type": {"application/http"},
+		"Content-Id":   {"<response-" + contentID + ">"},
+	}, buf.Bytes())
+}
+
+func sendBatchError(pw *partWriter, err error) {
+	pw.sendJSON(map[string]string{"type": "error", "error": err.Error()})
+}
+
+func randomBoundary() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return "batch_" + hex.EncodeToString(b[:])
+}
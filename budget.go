@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// parseBudget reads the overall time budget of a /stream request from the
+// budget query parameter or the X-Stream-Budget header. Zero means none.
+func parseBudget(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("budget")
+	if value == "" {
+		value = r.Header.Get("X-Stream-Budget")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	budget, err := time.ParseDuration(value)
+	if err != nil || budget <= 0 {
+		return 0, fmt.Errorf("invalid budget %q", value)
+	}
+	return budget, nil
+}
+
+type sourceProgress struct {
+	Delivered int  `json:"delivered"`
+	Complete  bool `json:"complete"`
+}
+
+// resumeCursor records how many parts each unfinished source had delivered,
+// and the version of the data they read. A nil cursor means start every
+// source from the beginning.
+type resumeCursor struct {
+	Version uint64         `json:"version"`
+	Offsets map[string]int `json:"offsets"`
+}
+
+// offset returns where src should start and whether it should run at all.
+func (c *resumeCursor) offset(name string) (int, bool) {
+	if c == nil {
+		return 0, true
+	}
+	offset, ok := c.Offsets[name]
+	return offset, ok
+}
+
+// stale reports whether the local data a cursor resumes has changed since,
+// which would shift the offsets. The store keeps no older snapshots to read
+// instead.
+func (c *resumeCursor) stale(snap *snapshot) bool {
+	for name := range c.Offsets {
+		if isLocal(name) {
+			return snap.Version("post", "comment", "user") > c.Version
+		}
+	}
+	return false
+}
+
+func decodeResume(value string) (*resumeCursor, error) {
+	if value == "" {
+		return nil, nil
+	}
+	cursorJSON, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resume cursor")
+	}
+	var cursor resumeCursor
+	if err := json.Unmarshal(cursorJSON, &cursor); err != nil || cursor.Offsets == nil {
+		return nil, fmt.Errorf("invalid resume cursor")
+	}
+	return &cursor, nil
+}
+
+func (c *resumeCursor) encode() string {
+	cursorJSON, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(cursorJSON)
+}
+
+// budgetSummary is the last part of a stream of the data at version cut short
+// by its budget. It lists the sources that did not finish and a cursor that
+// resumes exactly them. It reports false if every source finished after all.
+func budgetSummary(budget time.Duration, version uint64, progress map[string]sourceProgress) (map[string]any, bool) {
+	cursor := &resumeCursor{Version: version, Offsets: make(map[string]int)}
+	for name, p := range progress {
+		if !p.Complete {
+			cursor.Offsets[name] = p.Delivered
+		}
+	}
+	if len(cursor.Offsets) == 0 {
+		return nil, false
+	}
+	return map[string]any{
+		"type":        "summary",
+		"truncated":   true,
+		"budget":      budget.String(),
+		"sources":     progress,
+		"undelivered": slices.Sorted(maps.Keys(cursor.Offsets)),
+		"resume":      cursor.encode(),
+	}, true
+}
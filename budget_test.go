@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// budgetStream streams /stream with a budget too short for the sources and
+// returns the resume cursor of its summary.
+func budgetStream(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	streamHandler(w, httptest.NewRequest("GET", "/stream?budget=30ms", nil))
+	parts := readParts(t, w)
+	var summary struct {
+		Type   string `json:"type"`
+		Resume string `json:"resume"`
+	}
+	if len(parts) == 0 || json.Unmarshal(parts[len(parts)-1].Body, &summary) != nil || summary.Type != "summary" {
+		t.Fatalf("stream did not end with a summary: %q", bodies(parts))
+	}
+	return summary.Resume
+}
+
+func TestResumeCursor(t *testing.T) {
+	savedDB, savedLatency := db, emitLatency
+	db, emitLatency = newStore(posts, comments, users), 20*time.Millisecond
+	defer func() { db, emitLatency = savedDB, savedLatency }()
+
+	cursor := budgetStream(t)
+	resume, err := decodeResume(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resume.Version != db.snapshot().version || len(resume.Offsets) == 0 {
+		t.Errorf("cursor = %+v, want the offsets at version %d", resume, db.snapshot().version)
+	}
+	w := httptest.NewRecorder()
+	streamHandler(w, httptest.NewRequest("GET", "/stream?budget=30ms&resume="+cursor, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("resume of unchanged data: status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// A deletion shifts the offsets of the sources after it.
+	if err := db.Delete("comment", "c1", 1); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	streamHandler(w, httptest.NewRequest("GET", "/stream?resume="+cursor, nil))
+	if w.Code != http.StatusGone {
+		t.Errorf("resume of changed data: status = %d, want %d", w.Code, http.StatusGone)
+	}
+}
+
+func TestDecodeResume(t *testing.T) {
+	c := &resumeCursor{Version: 7, Offsets: map[string]int{"comment": 3}}
+	got, err := decodeResume(c.encode())
+	if err != nil || got.Version != 7 || got.Offsets["comment"] != 3 {
+		t.Errorf("decodeResume = %+v, %v", got, err)
+	}
+	for _, value := range []string{"!", "e30", "bnVsbA"} { // {} and null
+		if _, err := decodeResume(value); err == nil {
+			t.Errorf("decodeResume(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheTTLs holds how long each cached source's items are kept, set with
+// -cache. Sources without a TTL are not cached.
+var cacheTTLs = durationFlags{}
+
+type durationFlags map[string]time.Duration
+
+func (f durationFlags) String() string {
+	pairs := make([]string, 0, len(f))
+	for name, d := range f {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", name, d))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set parses name=duration pairs separated by commas.
+func (f durationFlags) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		name, v, ok := strings.Cut(pair, "=")
+		d, err := time.ParseDuration(v)
+		if !ok || err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration %q, want name=duration", pair)
+		}
+		f[name] = d
+	}
+	return nil
+}
+
+type cachedItem struct {
+	item Item[any]
+	at   time.Duration // since the start of the recorded run
+}
+
+type cacheEntry struct {
+	items   []cachedItem
+	expires time.Time
+}
+
+// sourceCache records complete runs of cached sources so that later requests
+// within the TTL can be served without running the producer again.
+type sourceCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry // by source name and forwarded headers
+}
+
+var cache = &sourceCache{entries: make(map[string]*cacheEntry)}
+
+func init() {
+	db.onWrite(invalidateCache)
+}
+
+// invalidateCache drops the cached runs of the source a write changed.
+func invalidateCache(c change) { cache.invalidate(c.Entity) }
+
+// invalidate drops the entries of the named source, or all entries if name is
+// empty.
+func (c *sourceCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if name == "" || strings.SplitN(key, "\n", 2)[0] == name {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *sourceCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return e
+}
+
+func (c *sourceCache) put(key string, e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = e
+}
+
+// wrap puts the cache in front of every source that has a TTL. A fresh entry
+// is bound to the source right away, so it is used even if it expires before
+// the source runs. The returned status is HIT if every cached source is
+// served from the cache and MISS otherwise; it is empty if no source is
+// cached. Runs of local sources are cached per version of the data they
+// read. With replayPacing, hits are sent with the timing of the recorded run
+// instead of all at once.
+func (c *sourceCache) wrap(sources []Source[any], r *http.Request, version uint64, replayPacing bool) ([]Source[any], string) {
+	status := ""
+	wrapped := make([]Source[any], len(sources))
+	for i, src := range sources {
+		ttl, ok := cacheTTLs[src.Name]
+		if !ok {
+			wrapped[i] = src
+			continue
+		}
+		key := src.Name + "\npath: " + r.URL.Path
+		for _, param := range []string{"since", "limit", "cursor"} {
+			key += "\n" + param + ": " + r.URL.Query().Get(param)
+		}
+		if isLocal(src.Name) {
+			key += "\nversion: " + strconv.FormatUint(version, 10)
+		}
+		for _, name := range forwardHeaders {
+			key += "\n" + name + ": " + strings.Join(r.Header.Values(name), ",")
+		}
+		if e := c.get(key); e != nil {
+			wrapped[i] = e.source(src.Name, replayPacing)
+			if status == "" {
+				status = "HIT"
+			}
+		} else {
+			wrapped[i] = c.record(src, key, ttl)
+			status = "MISS"
+		}
+	}
+	return wrapped, status
+}
+
+// record runs src and, if a run from the start completes, stores its items.
+func (c *sourceCache) record(src Source[any], key string, ttl time.Duration) Source[any] {
+	return Source[any]{Name: src.Name, Run: func(ctx context.Context, offset int, ch chan<- Item[any]) error {
+		start := time.Now()
+		recorded := make(chan Item[any])
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- src.Run(ctx, offset, recorded)
+			close(recorded)
+		}()
+
+		var items []cachedItem
+		for it := range recorded {
+			items = append(items, cachedItem{item: it, at: time.Since(start)})
+			forward(ctx, ch, it)
+		}
+		err := <-errCh
+		if err == nil && offset == 0 && ctx.Err() == nil {
+			c.put(key, &cacheEntry{items: items, expires: time.Now().Add(ttl)})
+		}
+		return err
+	}}
+}
+
+// source replays the entry.
+func (e *cacheEntry) source(name string, replayPacing bool) Source[any] {
+	return Source[any]{Name: name, Run: func(ctx context.Context, offset int, ch chan<- Item[any]) error {
+		start := time.Now()
+		for _, ci := range e.items[min(offset, len(e.items)):] {
+			if replayPacing {
+				select {
+				case <-time.After(ci.at - time.Since(start)):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			if !forward(ctx, ch, ci.item) {
+				return ctx.Err()
+			}
+		}
+		return nil
+	}}
+}
+
+// invalidateCacheHandler serves POST /admin/cache/invalidate. ?source= limits
+// it to one source.
+func invalidateCacheHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("source")
+	cache.invalidate(name)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"invalidated": cmp.Or(name, "all")})
+}
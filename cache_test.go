@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/M0rfes/multipart-mixed/client"
+)
+
+// useCache gives the test an empty cache and caches the named sources for ttl.
+func useCache(t *testing.T, ttl time.Duration, names ...string) {
+	t.Helper()
+	saved, savedTTLs := cache, cacheTTLs
+	cache, cacheTTLs = &sourceCache{entries: make(map[string]*cacheEntry)}, durationFlags{}
+	for _, name := range names {
+		cacheTTLs[name] = ttl
+	}
+	t.Cleanup(func() { cache, cacheTTLs = saved, savedTTLs })
+}
+
+// cachedSources returns the names of the sources with a cache entry.
+func cachedSources() []string {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	var names []string
+	for key := range cache.entries {
+		names = append(names, strings.SplitN(key, "\n", 2)[0])
+	}
+	slices.Sort(names)
+	return names
+}
+
+func fillCache(names ...string) {
+	for _, name := range names {
+		cache.put(name+"\npath: /stream", &cacheEntry{expires: time.Now().Add(time.Minute)})
+	}
+}
+
+// A stream is recorded on a miss and served from the cache until its TTL is
+// over.
+func TestCacheHit(t *testing.T) {
+	savedDB, savedLatency := db, emitLatency
+	db, emitLatency = newStore(posts, comments, users), time.Millisecond
+	defer func() { db, emitLatency = savedDB, savedLatency }()
+	useCache(t, 200*time.Millisecond, "post", "comment", "user")
+	srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer srv.Close()
+
+	get := func(want string) client.Entities {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if got := resp.Header.Get("X-Cache"); got != want {
+			t.Errorf("X-Cache = %q, want %q", got, want)
+		}
+		entities := make(client.Entities)
+		if err := entities.ReadStream(resp); err != nil {
+			t.Fatal(err)
+		}
+		return entities
+	}
+	miss := get("MISS")
+	if hit := get("HIT"); !reflect.DeepEqual(hit, miss) {
+		t.Errorf("hit = %v, want %v", hit, miss)
+	}
+	time.Sleep(250 * time.Millisecond)
+	get("MISS")
+}
+
+func TestCacheInvalidatedByWrites(t *testing.T) {
+	savedDB := db
+	db = newStore(posts, comments, users)
+	db.onWrite(invalidateCache)
+	defer func() { db = savedDB }()
+	useCache(t, time.Minute)
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /posts/{id}", putHandler("post"))
+	mux.HandleFunc("DELETE /comments/{id}", deleteHandler("comment"))
+
+	fillCache("post", "comment", "user")
+	p := db.snapshot().Posts()[0]
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("PUT", "/posts/"+p.ID, strings.NewReader(`{"data":"changed","version":1}`)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	if got, want := cachedSources(), []string{"comment", "user"}; !slices.Equal(got, want) {
+		t.Errorf("after a PUT, cached = %v, want %v", got, want)
+	}
+
+	c := db.snapshot().Comments()[0]
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("DELETE", "/comments/"+c.ID, nil)
+	r.Header.Set("If-Match", `"1"`)
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	if got, want := cachedSources(), []string{"user"}; !slices.Equal(got, want) {
+		t.Errorf("after a DELETE, cached = %v, want %v", got, want)
+	}
+}
+
+func TestInvalidateCacheHandler(t *testing.T) {
+	useCache(t, time.Minute)
+	fillCache("post", "comment", "user")
+	invalidate := func(target, want string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		invalidateCacheHandler(w, httptest.NewRequest("POST", target, nil))
+		if got := strings.TrimSpace(w.Body.String()); got != want {
+			t.Errorf("%s: body = %s, want %s", target, got, want)
+		}
+	}
+
+	invalidate("/admin/cache/invalidate?source=post", `{"invalidated":"post"}`)
+	if got, want := cachedSources(), []string{"comment", "user"}; !slices.Equal(got, want) {
+		t.Errorf("cached = %v, want %v", got, want)
+	}
+	invalidate("/admin/cache/invalidate", `{"invalidated":"all"}`)
+	if got := cachedSources(); got != nil {
+		t.Errorf("cached = %v, want none", got)
+	}
+}
+
+// numbers is a source of the items 0 to n-1 that returns err at the end.
+func numbers(n int, err error) Source[any] {
+	return Source[any]{Name: "numbers", Run: func(ctx context.Context, offset int, ch chan<- Item[any]) error {
+		for i := offset; i < n; i++ {
+			if !forward(ctx, ch, Item[any]{Type: "number", ID: string(rune('a' + i)), Value: i}) {
+				return ctx.Err()
+			}
+		}
+		return err
+	}}
+}
+
+// sourceValues runs src to the end and returns the values it sent.
+func sourceValues(ctx context.Context, src Source[any], offset int) []any {
+	ch := make(chan Item[any])
+	go func() {
+		src.Run(ctx, offset, ch)
+		close(ch)
+	}()
+	var vs []any
+	for it := range ch {
+		vs = append(vs, it.Value)
+	}
+	return vs
+}
+
+// Only a complete run from the start is recorded.
+func TestCacheRecordsCompleteRuns(t *testing.T) {
+	useCache(t, time.Minute)
+	canceled, cancel := context.WithCancel(t.Context())
+	cancel()
+	for _, tc := range []struct {
+		name   string
+		ctx    context.Context
+		src    Source[any]
+		offset int
+		cached bool
+	}{
+		{"complete", t.Context(), numbers(3, nil), 0, true},
+		{"from an offset", t.Context(), numbers(3, nil), 1, false},
+		{"canceled", canceled, numbers(3, nil), 0, false},
+		{"failed", t.Context(), numbers(3, errors.New("boom")), 0, false},
+	} {
+		cache.invalidate("")
+		sourceValues(tc.ctx, cache.record(tc.src, "numbers", time.Minute), tc.offset)
+		if e := cache.get("numbers"); (e != nil) != tc.cached {
+			t.Errorf("%s: cached = %v, want %v", tc.name, e != nil, tc.cached)
+		}
+	}
+
+	sourceValues(t.Context(), cache.record(numbers(3, nil), "numbers", time.Minute), 0)
+	e := cache.get("numbers")
+	if got, want := sourceValues(t.Context(), e.source("numbers", false), 1), []any{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replay from offset 1 = %v, want %v", got, want)
+	}
+}
+
+// With replay pacing a hit takes as long as the recorded run; without, it is
+// sent at once.
+func TestCacheReplayPacing(t *testing.T) {
+	e := &cacheEntry{items: []cachedItem{
+		{item: Item[any]{Value: 0}},
+		{item: Item[any]{Value: 1}, at: 40 * time.Millisecond},
+		{item: Item[any]{Value: 2}, at: 80 * time.Millisecond},
+	}}
+	for _, tc := range []struct {
+		pacing   bool
+		min, max time.Duration
+	}{
+		{false, 0, 30 * time.Millisecond},
+		{true, 80 * time.Millisecond, time.Second},
+	} {
+		start := time.Now()
+		got := sourceValues(t.Context(), e.source("numbers", tc.pacing), 0)
+		elapsed := time.Since(start)
+		if want := []any{0, 1, 2}; !reflect.DeepEqual(got, want) {
+			t.Errorf("pacing %v: items = %v, want %v", tc.pacing, got, want)
+		}
+		if elapsed < tc.min || elapsed > tc.max {
+			t.Errorf("pacing %v: took %v, want between %v and %v", tc.pacing, elapsed, tc.min, tc.max)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	streamHandler(w, httptest.NewRequest("GET", "/stream?pacing=fast", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("pacing=fast: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
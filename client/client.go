@@ -0,0 +1,387 @@
+// Package client keeps a local copy of the entities sent by a /stream
+// response, applying entity, tombstone and patch parts as they arrive.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Entities holds decoded entities by key, "post/p1" for example, which is
+// also the Content-ID of the part that last sent them whole.
+type Entities map[string]any
+
+// ReadStream applies every part of a multipart/mixed response until it ends.
+func (e Entities) ReadStream(resp *http.Response) error {
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	if mediaType != "multipart/mixed" {
+		return fmt.Errorf("unexpected content type %s", mediaType)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			return err
+		}
+		if err := e.Apply(part.Header, body); err != nil {
+			return err
+		}
+	}
+}
+
+// Apply applies one part. Parts that carry no entities, such as status parts,
+// are ignored.
+func (e Entities) Apply(header textproto.MIMEHeader, body []byte) error {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	switch mediaType {
+	case "application/json-patch+json":
+		key, doc, err := e.target(header)
+		if err != nil {
+			return err
+		}
+		var ops []op
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return err
+		}
+		for _, o := range ops {
+			if doc, err = o.apply(doc); err != nil {
+				return fmt.Errorf("patching %s: %w", key, err)
+			}
+		}
+		e[key] = doc
+		return nil
+	case "application/merge-patch+json":
+		key, doc, err := e.target(header)
+		if err != nil {
+			return err
+		}
+		var patch any
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return err
+		}
+		e[key] = mergePatch(doc, patch)
+		return nil
+	case "application/json":
+		return e.applyJSON(body)
+	}
+	return nil
+}
+
+// target returns the entity a patch part refers to with its Content-Location.
+func (e Entities) target(header textproto.MIMEHeader) (string, any, error) {
+	key, ok := strings.CutPrefix(header.Get("Content-Location"), "cid:")
+	if !ok {
+		return "", nil, errors.New("patch part has no cid: Content-Location")
+	}
+	doc, ok := e[key]
+	if !ok {
+		return "", nil, fmt.Errorf("patch for unknown entity %s", key)
+	}
+	return key, doc, nil
+}
+
+// applyJSON applies an entity envelope, {"type":"post","p1":{...},...}, a
+// tombstone or an aggregate, which is kept under "aggregate/<name>".
+func (e Entities) applyJSON(body []byte) error {
+	var part map[string]json.RawMessage
+	if err := json.Unmarshal(body, &part); err != nil {
+		// Not an object, so not an entity part.
+		return nil
+	}
+	var typ string
+	if err := json.Unmarshal(part["type"], &typ); err != nil {
+		return nil
+	}
+	if typ == "tombstone" {
+		var t struct{ Entity, ID string }
+		if err := json.Unmarshal(body, &t); err != nil {
+			return err
+		}
+		delete(e, t.Entity+"/"+t.ID)
+		return nil
+	}
+	if typ == "aggregate" {
+		// Each aggregate part holds only the keys that changed.
+		for name, raw := range part {
+			if name == "type" {
+				continue
+			}
+			var counts any
+			if err := json.Unmarshal(raw, &counts); err != nil {
+				return err
+			}
+			e["aggregate/"+name] = mergePatch(e["aggregate/"+name], counts)
+		}
+		return nil
+	}
+	entities := make(map[string]any, len(part)-1)
+	for id, raw := range part {
+		if id == "type" {
+			continue
+		}
+		var v any
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return err
+		}
+		// Control parts such as status have plain values; entities are
+		// objects.
+		if _, ok := v.(map[string]any); !ok {
+			return nil
+		}
+		entities[typ+"/"+id] = v
+	}
+	for key, v := range entities {
+		e[key] = v
+	}
+	return nil
+}
+
+// op is one RFC 6902 operation.
+type op struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (o op) apply(doc any) (any, error) {
+	switch o.Op {
+	case "add", "replace", "test":
+		if o.Value == nil {
+			return nil, fmt.Errorf("%s %s has no value", o.Op, o.Path)
+		}
+		var v any
+		if err := json.Unmarshal(o.Value, &v); err != nil {
+			return nil, err
+		}
+		switch o.Op {
+		case "add":
+			return add(doc, o.Path, v)
+		case "replace":
+			doc, _, err := remove(doc, o.Path)
+			if err != nil {
+				return nil, err
+			}
+			return add(doc, o.Path, v)
+		}
+		got, err := get(doc, o.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(got, v) {
+			return nil, fmt.Errorf("test %s failed", o.Path)
+		}
+		return doc, nil
+	case "remove":
+		doc, _, err := remove(doc, o.Path)
+		return doc, err
+	case "move", "copy":
+		v, err := get(doc, o.From)
+		if err != nil {
+			return nil, err
+		}
+		if o.Op == "move" {
+			if strings.HasPrefix(o.Path, o.From+"/") {
+				return nil, fmt.Errorf("cannot move %s into itself", o.From)
+			}
+			if doc, _, err = remove(doc, o.From); err != nil {
+				return nil, err
+			}
+		} else {
+			// Copy through JSON so the two locations don't share values.
+			data, _ := json.Marshal(v)
+			json.Unmarshal(data, &v)
+		}
+		return add(doc, o.Path, v)
+	}
+	return nil, fmt.Errorf("unknown op %q", o.Op)
+}
+
+// pointer splits a JSON Pointer (RFC 6901) into unescaped tokens.
+func pointer(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if path[0] != '/' {
+		return nil, fmt.Errorf("invalid pointer %q", path)
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+func get(doc any, path string) (any, error) {
+	tokens, err := pointer(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		switch node := doc.(type) {
+		case map[string]any:
+			v, ok := node[t]
+			if !ok {
+				return nil, fmt.Errorf("%s not found", path)
+			}
+			doc = v
+		case []any:
+			i, err := index(t, len(node))
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("%s not found", path)
+		}
+	}
+	return doc, nil
+}
+
+// add sets path to v, inserting into arrays, and returns the new document.
+func add(doc any, path string, v any) (any, error) {
+	tokens, err := pointer(path)
+	if err != nil {
+		return nil, err
+	}
+	return update(doc, tokens, func(parent any, last string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			node[last] = v
+			return node, nil
+		case []any:
+			if last == "-" {
+				return append(node, v), nil
+			}
+			i, err := index(last, len(node)+1)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = v
+			return node, nil
+		}
+		return nil, fmt.Errorf("cannot add to %s", path)
+	}, v)
+}
+
+// remove deletes path and returns the new document and the removed value.
+func remove(doc any, path string) (any, any, error) {
+	tokens, err := pointer(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, doc, nil
+	}
+	var removed any
+	doc, err = update(doc, tokens, func(parent any, last string) (any, error) {
+		switch node := parent.(type) {
+		case map[string]any:
+			v, ok := node[last]
+			if !ok {
+				return nil, fmt.Errorf("%s not found", path)
+			}
+			removed = v
+			delete(node, last)
+			return node, nil
+		case []any:
+			i, err := index(last, len(node))
+			if err != nil {
+				return nil, err
+			}
+			removed = node[i]
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%s not found", path)
+	}, nil)
+	return doc, removed, err
+}
+
+// update walks to the parent of the last token and replaces it with what f
+// returns. An empty pointer replaces the whole document with root.
+func update(doc any, tokens []string, f func(parent any, last string) (any, error), root any) (any, error) {
+	if len(tokens) == 0 {
+		return root, nil
+	}
+	if len(tokens) == 1 {
+		return f(doc, tokens[0])
+	}
+	switch node := doc.(type) {
+	case map[string]any:
+		child, ok := node[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("/%s not found", tokens[0])
+		}
+		child, err := update(child, tokens[1:], f, root)
+		if err != nil {
+			return nil, err
+		}
+		node[tokens[0]] = child
+		return node, nil
+	case []any:
+		i, err := index(tokens[0], len(node))
+		if err != nil {
+			return nil, err
+		}
+		child, err := update(node[i], tokens[1:], f, root)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = child
+		return node, nil
+	}
+	return nil, fmt.Errorf("/%s not found", tokens[0])
+}
+
+// index parses an array index, which must be below n.
+func index(token string, n int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i >= n || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return i, nil
+}
+
+// mergePatch applies an RFC 7396 merge patch to doc.
+func mergePatch(doc, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]any)
+	if !ok {
+		d = make(map[string]any)
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+		} else {
+			d[k] = mergePatch(d[k], v)
+		}
+	}
+	return d
+}
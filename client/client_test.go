@@ -0,0 +1,169 @@
+package client
+
+import (
+	"encoding/json"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func header(contentType, location string) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{"Content-Type": {contentType}}
+	if location != "" {
+		h.Set("Content-Location", location)
+	}
+	return h
+}
+
+func decode(t *testing.T, s string) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// withPost returns entities holding one post, post/p1.
+func withPost(t *testing.T) Entities {
+	t.Helper()
+	e := make(Entities)
+	if err := e.Apply(header("application/json", ""), []byte(`{"type":"post","p1":{"id":"p1","tags":["a","b"],"meta":{"a/b":1,"m~n":2}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestJSONPatch(t *testing.T) {
+	for _, tc := range []struct {
+		name, patch, want string
+	}{
+		{"add", `[{"op":"add","path":"/title","value":"hi"}]`,
+			`{"id":"p1","title":"hi","tags":["a","b"],"meta":{"a/b":1,"m~n":2}}`},
+		{"add to array", `[{"op":"add","path":"/tags/1","value":"x"}]`,
+			`{"id":"p1","tags":["a","x","b"],"meta":{"a/b":1,"m~n":2}}`},
+		{"append to array", `[{"op":"add","path":"/tags/-","value":"x"}]`,
+			`{"id":"p1","tags":["a","b","x"],"meta":{"a/b":1,"m~n":2}}`},
+		{"add at the end of an array", `[{"op":"add","path":"/tags/2","value":"x"}]`,
+			`{"id":"p1","tags":["a","b","x"],"meta":{"a/b":1,"m~n":2}}`},
+		{"replace", `[{"op":"replace","path":"/tags/0","value":"z"}]`,
+			`{"id":"p1","tags":["z","b"],"meta":{"a/b":1,"m~n":2}}`},
+		{"remove", `[{"op":"remove","path":"/tags/0"}]`,
+			`{"id":"p1","tags":["b"],"meta":{"a/b":1,"m~n":2}}`},
+		{"escaped slash", `[{"op":"replace","path":"/meta/a~1b","value":3}]`,
+			`{"id":"p1","tags":["a","b"],"meta":{"a/b":3,"m~n":2}}`},
+		{"escaped tilde", `[{"op":"remove","path":"/meta/m~0n"}]`,
+			`{"id":"p1","tags":["a","b"],"meta":{"a/b":1}}`},
+		{"move", `[{"op":"move","from":"/tags/0","path":"/first"}]`,
+			`{"id":"p1","first":"a","tags":["b"],"meta":{"a/b":1,"m~n":2}}`},
+		{"copy", `[{"op":"copy","from":"/meta","path":"/copied"},{"op":"replace","path":"/copied/a~1b","value":9}]`,
+			`{"id":"p1","tags":["a","b"],"meta":{"a/b":1,"m~n":2},"copied":{"a/b":9,"m~n":2}}`},
+		{"test", `[{"op":"test","path":"/tags","value":["a","b"]},{"op":"remove","path":"/meta"}]`,
+			`{"id":"p1","tags":["a","b"]}`},
+		{"whole document", `[{"op":"replace","path":"","value":{"id":"p1"}}]`,
+			`{"id":"p1"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := withPost(t)
+			if err := e.Apply(header("application/json-patch+json", "cid:post/p1"), []byte(tc.patch)); err != nil {
+				t.Fatal(err)
+			}
+			if want := decode(t, tc.want); !reflect.DeepEqual(e["post/p1"], want) {
+				t.Errorf("post/p1 = %v, want %v", e["post/p1"], want)
+			}
+		})
+	}
+}
+
+func TestJSONPatchErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, location, patch string
+	}{
+		{"unknown entity", "cid:post/p9", `[{"op":"remove","path":"/id"}]`},
+		{"no Content-Location", "", `[{"op":"remove","path":"/id"}]`},
+		{"unknown op", "cid:post/p1", `[{"op":"swap","path":"/id"}]`},
+		{"missing member", "cid:post/p1", `[{"op":"remove","path":"/title"}]`},
+		{"missing parent", "cid:post/p1", `[{"op":"add","path":"/a/b","value":1}]`},
+		{"index out of range", "cid:post/p1", `[{"op":"replace","path":"/tags/2","value":"x"}]`},
+		{"index with a leading zero", "cid:post/p1", `[{"op":"remove","path":"/tags/01"}]`},
+		{"invalid pointer", "cid:post/p1", `[{"op":"remove","path":"tags"}]`},
+		{"no value", "cid:post/p1", `[{"op":"add","path":"/title"}]`},
+		{"failed test", "cid:post/p1", `[{"op":"test","path":"/id","value":"p2"}]`},
+		{"move into itself", "cid:post/p1", `[{"op":"move","from":"/meta","path":"/meta/inner"}]`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := withPost(t)
+			if err := e.Apply(header("application/json-patch+json", tc.location), []byte(tc.patch)); err == nil {
+				t.Errorf("no error, post/p1 = %v", e["post/p1"])
+			}
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	e := withPost(t)
+	if err := e.Apply(header("application/merge-patch+json", "cid:post/p1"), []byte(`{"title":"hi","tags":["c"],"meta":{"a/b":null,"x":{"y":1}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	want := decode(t, `{"id":"p1","title":"hi","tags":["c"],"meta":{"m~n":2,"x":{"y":1}}}`)
+	if !reflect.DeepEqual(e["post/p1"], want) {
+		t.Errorf("post/p1 = %v, want %v", e["post/p1"], want)
+	}
+
+	err := e.Apply(header("application/merge-patch+json", "cid:post/p9"), []byte(`{"title":"hi"}`))
+	if err == nil || !strings.Contains(err.Error(), "post/p9") {
+		t.Errorf("patch of an unknown entity: err = %v", err)
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	e := withPost(t)
+	e["post/p2"] = map[string]any{"id": "p2"}
+	if err := e.Apply(header("application/json", ""), []byte(`{"type":"tombstone","entity":"post","id":"p1","version":7}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := e["post/p1"]; ok {
+		t.Error("post/p1 was not deleted")
+	}
+	if _, ok := e["post/p2"]; !ok {
+		t.Error("post/p2 was deleted too")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	e := make(Entities)
+	for _, part := range []string{
+		`{"type":"aggregate","commentsPerUser":{"u1":2,"u2":1}}`,
+		`{"type":"aggregate","commentsPerUser":{"u2":3},"commentsPerPost":{"p1":4}}`,
+	} {
+		if err := e.Apply(header("application/json", ""), []byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := Entities{
+		"aggregate/commentsPerUser": decode(t, `{"u1":2,"u2":3}`),
+		"aggregate/commentsPerPost": decode(t, `{"p1":4}`),
+	}
+	if !reflect.DeepEqual(e, want) {
+		t.Errorf("entities = %v, want %v", e, want)
+	}
+}
+
+// Parts that are not entities are left alone.
+func TestIgnoredParts(t *testing.T) {
+	e := withPost(t)
+	for _, p := range []struct{ contentType, body string }{
+		{"application/json", `{"type":"status","status":"done"}`},
+		{"application/json", `[1,2]`},
+		{"application/json", `{"no":"type"}`},
+		{"text/plain", `hello`},
+	} {
+		if err := e.Apply(header(p.contentType, ""), []byte(p.body)); err != nil {
+			t.Errorf("%s: %v", p.body, err)
+		}
+	}
+	if len(e) != 1 {
+		t.Errorf("entities = %v, want only post/p1", e)
+	}
+}
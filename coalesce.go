@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// batchPolicy decides how many consecutive items of a source share a part; see
+// Batch. A part is flushed once it holds maxItems items or maxBytes bytes, or
+// linger after its first item arrived, whichever comes first. Zero limits are
+// unbounded; maxItems 1 sends every item on its own.
+type batchPolicy struct {
+	maxItems int
+	maxBytes int
+	linger   time.Duration
+}
+
+// batchPolicies holds the policy of each source, set with -batch. Comments are
+// sent in pairs unless they are more than a second apart.
+var batchPolicies = batchFlags{
+	"comment": {maxItems: 2, linger: time.Second},
+}
+
+type batchFlags map[string]batchPolicy
+
+func (f batchFlags) get(name string) batchPolicy {
+	if p, ok := f[name]; ok {
+		return p
+	}
+	return batchPolicy{maxItems: 1}
+}
+
+func (f batchFlags) String() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	specs := make([]string, len(names))
+	for i, name := range names {
+		p := f[name]
+		specs[i] = fmt.Sprintf("%s=items:%d;bytes:%d;linger:%s", name, p.maxItems, p.maxBytes, p.linger)
+	}
+	return strings.Join(specs, " ")
+}
+
+// Set parses name=items:n;bytes:n;linger:duration. Omitted limits are
+// unbounded.
+func (f batchFlags) Set(spec string) error {
+	name, opts, ok := strings.Cut(spec, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("invalid batch policy %q, want name=items:n;bytes:n;linger:d", spec)
+	}
+	var p batchPolicy
+	for _, opt := range strings.Split(opts, ";") {
+		key, value, _ := strings.Cut(opt, ":")
+		var err error
+		switch key {
+		case "items":
+			p.maxItems, err = strconv.Atoi(value)
+		case "bytes":
+			p.maxBytes, err = strconv.Atoi(value)
+		case "linger":
+			p.linger, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid batch policy %q: %w", spec, err)
+		}
+	}
+	f[name] = p
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// partBuffer holds an encoded part, framing included, so it can be sent with
+// a single write. Buffers are pooled; release returns one to the pool.
+type partBuffer struct {
+	bytes.Buffer
+	enc   *json.Encoder
+	spans []partSpan // the parts in the buffer, usually one
+}
+
+// partSpan locates a part in an encoded buffer, so interceptors can see it
+// without parsing the framing back.
+type partSpan struct {
+	header     http.Header // as given to encodePart, without its defaults
+	contentID  string
+	start, end int // the body
+}
+
+// part returns the part span locates in data.
+func (s partSpan) part(data []byte) part {
+	header := s.header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "application/json")
+	}
+	if s.contentID != "" {
+		header["Content-ID"] = []string{"<" + s.contentID + ">"}
+	}
+	return part{Header: header, Body: data[s.start:s.end]}
+}
+
+var partBuffers = sync.Pool{New: func() any {
+	b := new(partBuffer)
+	b.enc = json.NewEncoder(&b.Buffer)
+	return b
+}}
+
+func getPartBuffer() *partBuffer {
+	b := partBuffers.Get().(*partBuffer)
+	b.Reset()
+	b.spans = b.spans[:0]
+	return b
+}
+
+func (b *partBuffer) release() {
+	// Don't keep the occasional huge part around.
+	if b.Cap() <= 64<<10 {
+		partBuffers.Put(b)
+	}
+}
+
+// encode appends v as JSON without the newline json.Encoder adds.
+func (b *partBuffer) encode(v any) error {
+	if err := b.enc.Encode(v); err != nil {
+		return err
+	}
+	b.Truncate(b.Len() - 1)
+	return nil
+}
+
+// encodeJSONPart frames a JSON body as a part with the given boundary and
+// extra headers. A Content-Type in header overrides application/json.
+func encodeJSONPart(boundary string, header http.Header, body func(b *partBuffer) error) (*partBuffer, error) {
+	return encodePart(boundary, header, "", body)
+}
+
+// encodePart is encodeJSONPart with a Content-ID, which is left out if empty.
+func encodePart(boundary string, header http.Header, contentID string, body func(b *partBuffer) error) (*partBuffer, error) {
+	b := getPartBuffer()
+	b.WriteString("--")
+	b.WriteString(boundary)
+	b.WriteString("\r\nContent-Type: ")
+	b.WriteString(cmp.Or(header.Get("Content-Type"), "application/json"))
+	b.WriteString("\r\n")
+	if contentID != "" {
+		b.WriteString("Content-ID: <")
+		b.WriteString(contentID)
+		b.WriteString(">\r\n")
+	}
+	if len(header) > 0 {
+		header.WriteSubset(b, map[string]bool{"Content-Type": true})
+	}
+	b.WriteString("\r\n")
+	start := b.Len()
+	if err := body(b); err != nil {
+		b.release()
+		return nil, err
+	}
+	b.spans = append(b.spans, partSpan{header: header, contentID: contentID, start: start, end: b.Len()})
+	b.WriteString("\r\n")
+	return b, nil
+}
+
+// appendParts appends the parts in o to b.
+func (b *partBuffer) appendParts(o *partBuffer) {
+	offset := b.Len()
+	b.Write(o.Bytes())
+	for _, s := range o.spans {
+		s.start += offset
+		s.end += offset
+		b.spans = append(b.spans, s)
+	}
+}
+
+// encodeBatch encodes a batch as one part. Entities are wrapped in the
+// {"type":...,"<id>":{...},...} envelope; a control item is encoded as is.
+// The headers of the first item become the part's headers. A part holding a
+// single entity gets its entity key as Content-ID, so that later patches can
+// refer to it.
+func encodeBatch(boundary string, batch []Item[any]) (*partBuffer, error) {
+	var contentID string
+	if len(batch) == 1 && batch[0].ID != "" {
+		contentID = entityKey(batch[0].Type, batch[0].ID)
+	}
+	return encodePart(boundary, batch[0].Header, contentID, func(b *partBuffer) error {
+		if batch[0].ID == "" {
+			return b.encode(batch[0].Value)
+		}
+		b.WriteString(`{"type":`)
+		if err := b.encode(batch[0].Type); err != nil {
+			return err
+		}
+		for _, it := range batch {
+			b.WriteByte(',')
+			if err := b.encode(it.ID); err != nil {
+				return err
+			}
+			b.WriteByte(':')
+			if err := b.encode(it.Value); err != nil {
+				return err
+			}
+		}
+		b.WriteByte('}')
+		return nil
+	})
+}
+
+// encodedSize estimates the bytes an entity adds to a part.
+func encodedSize(id string, value any) int {
+	b := getPartBuffer()
+	defer b.release()
+	if b.encode(value) != nil {
+		return 0
+	}
+	return b.Len() + len(id) + 4
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestEncodeBatch(t *testing.T) {
+	tests := []struct {
+		batch []Item[any]
+		want  string
+	}{
+		{
+			[]Item[any]{{Type: "post", ID: "p1", Value: Post{ID: "p1", Data: "a", Comments: []string{"c1"}, Version: 2}}},
+			"--b\r\nContent-Type: application/json\r\nContent-ID: <post/p1>\r\n\r\n" +
+				`{"type":"post","p1":{"id":"p1","data":"a","comments":["c1"],"version":2}}` + "\r\n",
+		},
+		{
+			[]Item[any]{{Type: "user", ID: "u1", Value: User{ID: "u1", Name: "Ann"}}, {Type: "user", ID: "u2", Value: User{ID: "u2"}}},
+			"--b\r\nContent-Type: application/json\r\n\r\n" +
+				`{"type":"user","u1":{"id":"u1","name":"Ann","version":0},"u2":{"id":"u2","name":"","version":0}}` + "\r\n",
+		},
+		{
+			[]Item[any]{{Value: map[string]string{"type": "summary"}, Header: http.Header{"X-Part": {"1"}}}},
+			"--b\r\nContent-Type: application/json\r\nX-Part: 1\r\n\r\n" + `{"type":"summary"}` + "\r\n",
+		},
+	}
+	for _, tt := range tests {
+		b, err := encodeBatch("b", tt.batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := b.String(); got != tt.want {
+			t.Errorf("encodeBatch = %q, want %q", got, tt.want)
+		}
+		b.release()
+	}
+}
+
+// benchEntities is how many posts a benchmarked stream sends.
+const benchEntities = 10_000
+
+func benchPosts() []Post {
+	posts := make([]Post, benchEntities)
+	for i := range posts {
+		id := fmt.Sprintf("p%d", i)
+		posts[i] = Post{ID: id, Data: "Post " + id + " with a little body text", Comments: []string{"c" + id, "d" + id}, Version: 1}
+	}
+	return posts
+}
+
+// discardWriter is a streaming response that drops what is written to it.
+type discardWriter struct{ header http.Header }
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+func (w *discardWriter) Flush()                      {}
+
+// SetWriteDeadline is supported, as it is by real connections.
+func (w *discardWriter) SetWriteDeadline(time.Time) error { return nil }
+
+// benchmarkStream runs send once per op, reporting parts/s and allocs/part
+// over the benchEntities parts each op sends.
+func benchmarkStream(b *testing.B, send func(w http.ResponseWriter, posts []Post)) {
+	posts := benchPosts()
+	w := &discardWriter{header: make(http.Header)}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for b.Loop() {
+		send(w, posts)
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	parts := float64(b.N * benchEntities)
+	b.ReportMetric(parts/b.Elapsed().Seconds(), "parts/s")
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/parts, "allocs/part")
+}
+
+// BenchmarkStreamBefore encodes parts the way /stream did before partBuffer:
+// a map per part, json.Marshal, a string copy and four writes.
+func BenchmarkStreamBefore(b *testing.B) {
+	benchmarkStream(b, func(w http.ResponseWriter, posts []Post) {
+		flusher := w.(http.Flusher)
+		for _, post := range posts {
+			postMap := make(map[string]any)
+			postMap["type"] = "post"
+			postMap[post.ID] = post
+			postJSON, err := json.Marshal(postMap)
+			if err != nil {
+				b.Fatal(err)
+			}
+			jsonPayload := string(postJSON)
+			fmt.Fprintf(w, "--%s\r\n", boundary)
+			fmt.Fprint(w, "Content-Type: application/json\r\n\r\n")
+			fmt.Fprint(w, jsonPayload)
+			fmt.Fprint(w, "\r\n")
+			flusher.Flush()
+		}
+	})
+}
+
+// BenchmarkStream encodes typed items straight into pooled buffers, written
+// with one write per part.
+func BenchmarkStream(b *testing.B) {
+	r := httptest.NewRequest("GET", "/stream", nil)
+	benchmarkStream(b, func(w http.ResponseWriter, posts []Post) {
+		pw, _ := newPartWriter(w, r)
+		batch := make([]Item[any], 1)
+		for _, post := range posts {
+			batch[0] = Item[any]{Type: "post", ID: post.ID, Value: post}
+			buf, err := encodeBatch(boundary, batch)
+			if err != nil {
+				b.Fatal(err)
+			}
+			pw.writeFrame(buf)
+		}
+		pw.close()
+	})
+}
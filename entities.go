@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// entityStreamHandler serves GET /{entity}s/{id}/stream: the entity and then
+// the ones related to it, a type at a time. A post is followed by its comments
+// and their users, a user by their comments and the posts those are on.
+func entityStreamHandler(entity string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		v := view{snap: db.snapshot()}
+		if _, ok := v.snap.get(entity, id); !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var sources []Source[any]
+		switch entity {
+		case "post":
+			v = v.scopeToPosts([]string{id})
+			sources = v.sources("post", "comment", "user")
+		case "user":
+			v = v.scopeToUser(id)
+			sources = v.sources("user", "comment", "post")
+		}
+		serveStream(w, r, sources, streamOptions{ordered: true})
+	}
+}
+
+// putHandler serves PUT /{entity}s/{id}. The body is the entity; the version
+// it replaces comes from If-Match or the body's version field, 0 to create it.
+func putHandler(entity string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var fields map[string]json.RawMessage
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxIngestPartSize)).Decode(&fields); err != nil {
+			http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+			return
+		}
+		id := r.PathValue("id")
+		if _, ok := fields["id"]; !ok {
+			fields["id"], _ = json.Marshal(id)
+		}
+		version, ok, err := ifMatch(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok {
+			fields["version"] = strconv.AppendUint(nil, version, 10)
+		} else if err := json.Unmarshal(fields["version"], &version); err != nil {
+			http.Error(w, "If-Match or a version field is required", http.StatusPreconditionRequired)
+			return
+		}
+		body, err := json.Marshal(fields)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		written, err := putEntities(entity, map[string]json.RawMessage{id: body})
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.Header().Set("ETag", entityETag(written))
+		if version == 0 {
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// deleteHandler serves DELETE /{entity}s/{id}. If-Match must name the
+// entity's current version.
+func deleteHandler(entity string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version, ok, err := ifMatch(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !ok {
+			http.Error(w, "If-Match is required", http.StatusPreconditionRequired)
+			return
+		}
+		if err := db.Delete(entity, r.PathValue("id"), version); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// putEntities decodes id-keyed entities of one type and writes them. It
+// returns the version written.
+func putEntities(entity string, fields map[string]json.RawMessage) (uint64, error) {
+	switch entity {
+	case "post":
+		ps, err := decodeEntities[Post](fields, func(p Post) string { return p.ID })
+		if err != nil {
+			return 0, err
+		}
+		return db.PutPosts(ps...)
+	case "comment":
+		cs, err := decodeEntities[Comment](fields, func(c Comment) string { return c.ID })
+		if err != nil {
+			return 0, err
+		}
+		return db.PutComments(cs...)
+	case "user":
+		us, err := decodeEntities[User](fields, func(u User) string { return u.ID })
+		if err != nil {
+			return 0, err
+		}
+		return db.PutUsers(us...)
+	}
+	return 0, fmt.Errorf("unknown type %q", entity)
+}
+
+// decodeEntities decodes the id-keyed entities of a part and checks that each
+// key matches the entity's own id and that it names the version it replaces.
+func decodeEntities[T any](fields map[string]json.RawMessage, id func(T) string) ([]T, error) {
+	items := make([]T, 0, len(fields))
+	for key, raw := range fields {
+		var item T
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+		if id(item) != key {
+			return nil, fmt.Errorf("key %s does not match id %q", key, id(item))
+		}
+		var versioned struct {
+			Version *uint64 `json:"version"`
+		}
+		if json.Unmarshal(raw, &versioned) != nil || versioned.Version == nil {
+			return nil, fmt.Errorf("%s has no version, use 0 to create it", key)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// ifMatch returns the version an If-Match header names. It must be a single
+// strong ETag, as sent by PUT; ok is false if there is no header.
+func ifMatch(r *http.Request) (version uint64, ok bool, err error) {
+	value := r.Header.Get("If-Match")
+	if value == "" {
+		return 0, false, nil
+	}
+	unquoted, err := strconv.Unquote(value)
+	if err == nil && value[0] == '"' {
+		if version, err = strconv.ParseUint(unquoted, 10, 64); err == nil {
+			return version, true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("invalid If-Match %s, want a version such as \"3\"", value)
+}
+
+func entityETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// writeStoreError replies to a failed write with its status.
+func writeStoreError(w http.ResponseWriter, err error) {
+	var conflict *conflictError
+	switch {
+	case errors.As(err, &conflict):
+		if conflict.Have != 0 {
+			w.Header().Set("ETag", entityETag(conflict.Have))
+		}
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case errors.Is(err, errNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// streamETag returns a weak ETag for a /stream request: the version of the
+// data its sources read, plus a hash of the request so different views of the
+// same data differ. Streams that include an upstream source have no ETag,
+// since their data has no version here.
+func streamETag(r *http.Request, sources []Source[any], snap *snapshot) (string, uint64, bool) {
+	entities := make([]string, 0, len(sources))
+	for _, src := range sources {
+		for _, u := range upstreams {
+			if u.name == src.Name {
+				return "", 0, false
+			}
+		}
+		if src.Name == "tombstone" {
+			entities = append(entities, "post", "comment", "user")
+		} else {
+			entities = append(entities, src.Name)
+		}
+	}
+	version := snap.Version(entities...)
+	h := fnv.New64a()
+	fmt.Fprint(h, streamKey(r))
+	return fmt.Sprintf(`W/"%d-%x"`, version, h.Sum64()), version, true
+}
+
+// etagMatches reports whether an If-None-Match header matches etag. Weak
+// comparison is used, as RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
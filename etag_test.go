@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A budget may truncate the stream, so its response must not be cacheable.
+func TestStreamETagBudget(t *testing.T) {
+	for _, tt := range []struct {
+		target, budgetHeader string
+		wantETag             bool
+	}{
+		{"/stream?limit=1", "", true},
+		{"/stream?limit=1&budget=1ms", "", false},
+		{"/stream?limit=1", "1ms", false},
+	} {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.budgetHeader != "" {
+			r.Header.Set("X-Stream-Budget", tt.budgetHeader)
+		}
+		r.Header.Set("If-None-Match", "*")
+		w := httptest.NewRecorder()
+		streamHandler(w, r)
+		if got := w.Header().Get("ETag") != ""; got != tt.wantETag {
+			t.Errorf("%s (X-Stream-Budget %q): ETag sent = %v, want %v", tt.target, tt.budgetHeader, got, tt.wantETag)
+		}
+		if !tt.wantETag && w.Code == http.StatusNotModified {
+			t.Errorf("%s (X-Stream-Budget %q): 304 for a budgeted stream", tt.target, tt.budgetHeader)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// broadcast is one run of a stream shared by every request with the same key.
+// All parts are kept, so subscribers that join late first get the parts sent
+// before they arrived.
+type broadcast struct {
+	key         string
+	cancel      context.CancelFunc
+	cacheStatus string // X-Cache of the run, if any source is cached
+
+	mu          sync.Mutex
+	frames      []replayFrame
+	changed     chan struct{} // closed and replaced whenever frames or done change
+	done        bool
+	subscribers int
+}
+
+// hub tracks the running broadcasts. A broadcast is removed once its stream
+// ends or its last subscriber leaves, so the next request starts a fresh run.
+type hub struct {
+	mu      sync.Mutex
+	streams map[string]*broadcast
+}
+
+var streamHub = &hub{streams: make(map[string]*broadcast)}
+
+// streamKey identifies requests that can share a stream: the same path, the
+// same query, the same budget, whether it comes from the query or
+// X-Stream-Budget, and the same headers forwarded to upstreams.
+func streamKey(r *http.Request) string {
+	var key strings.Builder
+	key.WriteString(r.URL.Path)
+	key.WriteString("?")
+	query := r.URL.Query()
+	query.Del("budget")
+	for _, values := range query {
+		sort.Strings(values)
+	}
+	key.WriteString(query.Encode())
+	if budget, err := parseBudget(r); err == nil && budget > 0 {
+		key.WriteString("\nbudget: " + budget.String())
+	}
+	for _, name := range forwardHeaders {
+		key.WriteString("\n" + name + ": " + url.QueryEscape(strings.Join(r.Header.Values(name), ",")))
+	}
+	return key.String()
+}
+
+// subscribe joins the broadcast for key. If there is none yet, prepare is
+// called to set up a run, which returns a function that starts it and the
+// cache status of the run. Callers must unsubscribe when they are done.
+func (h *hub) subscribe(key string, prepare func() (func(ctx context.Context) Stream[*partBuffer], string)) *broadcast {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if b, ok := h.streams[key]; ok {
+		b.mu.Lock()
+		b.subscribers++
+		b.mu.Unlock()
+		return b
+	}
+
+	start, cacheStatus := prepare()
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &broadcast{key: key, cancel: cancel, cacheStatus: cacheStatus, changed: make(chan struct{}), subscribers: 1}
+	h.streams[key] = b
+	go func() {
+		defer cancel()
+		for frame := range start(ctx) {
+			b.append(frame.Value)
+		}
+		b.finish()
+		h.remove(b)
+	}()
+	return b
+}
+
+// unsubscribe leaves b and stops its producers if nobody is left. The last
+// subscriber removes b before anyone else can join it, so a request never
+// joins a run that is being cancelled.
+func (h *hub) unsubscribe(b *broadcast) {
+	h.mu.Lock()
+	b.mu.Lock()
+	b.subscribers--
+	last := b.subscribers == 0
+	b.mu.Unlock()
+	if last && h.streams[b.key] == b {
+		delete(h.streams, b.key)
+	}
+	h.mu.Unlock()
+	if last {
+		b.cancel()
+	}
+}
+
+func (h *hub) remove(b *broadcast) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.streams[b.key] == b {
+		delete(h.streams, b.key)
+	}
+}
+
+// replayFrame is an encoded part kept for replay, with the spans of its parts.
+type replayFrame struct {
+	data  []byte
+	spans []partSpan
+}
+
+// append keeps a copy of the part, since the buffer goes back to the pool.
+func (b *broadcast) append(buf *partBuffer) {
+	defer buf.release()
+	f := replayFrame{data: append([]byte(nil), buf.Bytes()...), spans: slices.Clone(buf.spans)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.frames = append(b.frames, f)
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *broadcast) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done = true
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// follow writes the parts of b to pw, replaying those sent so far, until the
+// stream ends or ctx is done. Once caught up, a subscriber that falls more
+// than the stream buffer behind is handled according to the overflow policy:
+// it keeps reading from the replay buffer, skips ahead, or is disconnected
+// with errSlowClient. A write error is returned as is.
+func (b *broadcast) follow(ctx context.Context, pw *partWriter) error {
+	b.mu.Lock()
+	replay := len(b.frames)
+	b.mu.Unlock()
+
+	sent := 0
+	for {
+		b.mu.Lock()
+		frames := b.frames[sent:]
+		changed := b.changed
+		done := b.done
+		b.mu.Unlock()
+
+		if lag := len(frames) - streamBuffer.size; sent >= replay && lag > 0 {
+			switch streamBuffer.overflow {
+			case overflowDropOldest:
+				frames = frames[lag:]
+				sent += lag
+				droppedParts.Add(int64(lag))
+			case overflowDisconnect:
+				return errSlowClient
+			}
+		}
+		for _, f := range frames {
+			pw.writeEncoded(f.data, f.spans)
+			if pw.err != nil {
+				return pw.err
+			}
+		}
+		sent += len(frames)
+		if len(frames) > 0 {
+			continue
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamKeyBudget(t *testing.T) {
+	key := func(target, budgetHeader string) string {
+		r := httptest.NewRequest("GET", target, nil)
+		if budgetHeader != "" {
+			r.Header.Set("X-Stream-Budget", budgetHeader)
+		}
+		return streamKey(r)
+	}
+	if key("/stream", "1s") == key("/stream", "2s") {
+		t.Error("requests with different X-Stream-Budget share a key")
+	}
+	if key("/stream", "2s") == key("/stream", "") {
+		t.Error("a request with a budget shares a key with one without")
+	}
+	if key("/stream?budget=2s", "") != key("/stream", "2000ms") {
+		t.Error("the same budget from the query and the header gives different keys")
+	}
+}
+
+// postFrame encodes a part holding the post id.
+func postFrame(t *testing.T, id string) Item[*partBuffer] {
+	t.Helper()
+	b, err := encodeBatch(boundary, []Item[any]{{Type: "post", ID: id, Value: Post{ID: id}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Item[*partBuffer]{Type: "post", Value: b}
+}
+
+// followBroadcast follows b to the end and returns the response.
+func followBroadcast(b *broadcast) <-chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		pw, _ := newPartWriter(w, httptest.NewRequest("GET", "/stream", nil))
+		if b.follow(context.Background(), pw) == nil {
+			pw.close()
+		}
+		done <- w
+	}()
+	return done
+}
+
+func waitForFrames(b *broadcast, n int) {
+	for {
+		b.mu.Lock()
+		got := len(b.frames)
+		b.mu.Unlock()
+		if got >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A subscriber that joins a running broadcast gets the parts sent before it
+// came first, then the rest.
+func TestHubLateJoiner(t *testing.T) {
+	h := &hub{streams: make(map[string]*broadcast)}
+	frames := make(chan Item[*partBuffer])
+	b := h.subscribe("k", func() (func(context.Context) Stream[*partBuffer], string) {
+		return func(context.Context) Stream[*partBuffer] { return frames }, ""
+	})
+	first := followBroadcast(b)
+	frames <- postFrame(t, "p1")
+	frames <- postFrame(t, "p2")
+	waitForFrames(b, 2)
+
+	late := h.subscribe("k", func() (func(context.Context) Stream[*partBuffer], string) {
+		t.Error("a late joiner started a second run")
+		return nil, ""
+	})
+	if late != b {
+		t.Fatal("a late joiner got another broadcast")
+	}
+	second := followBroadcast(late)
+	frames <- postFrame(t, "p3")
+	close(frames)
+
+	for name, done := range map[string]<-chan *httptest.ResponseRecorder{"first": first, "late": second} {
+		parts := bodies(readParts(t, <-done))
+		if len(parts) != 3 {
+			t.Fatalf("%s: got %d parts, want 3: %q", name, len(parts), parts)
+		}
+		for i, id := range []string{"p1", "p2", "p3"} {
+			if !strings.Contains(parts[i], `"`+id+`"`) {
+				t.Errorf("%s: part %d = %s, want %s", name, i, parts[i], id)
+			}
+		}
+	}
+	h.unsubscribe(b)
+	h.unsubscribe(late)
+}
+
+// The run is canceled and forgotten once its last subscriber leaves, so the
+// next request starts a new one.
+func TestHubLastSubscriberLeaves(t *testing.T) {
+	h := &hub{streams: make(map[string]*broadcast)}
+	runs := 0
+	canceled := make(chan struct{})
+	prepare := func() (func(context.Context) Stream[*partBuffer], string) {
+		runs++
+		return func(ctx context.Context) Stream[*partBuffer] {
+			frames := make(chan Item[*partBuffer])
+			go func() {
+				<-ctx.Done()
+				close(canceled)
+				close(frames)
+			}()
+			return frames
+		}, ""
+	}
+	b := h.subscribe("k", prepare)
+	h.subscribe("k", prepare)
+
+	h.unsubscribe(b)
+	select {
+	case <-canceled:
+		t.Fatal("the run was canceled while it still had a subscriber")
+	case <-time.After(10 * time.Millisecond):
+	}
+	h.unsubscribe(b)
+	// It is gone before the run ends, so nobody joins a canceled run.
+	h.mu.Lock()
+	_, ok := h.streams["k"]
+	h.mu.Unlock()
+	if ok {
+		t.Error("the broadcast is still in the hub")
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("the run was not canceled when its last subscriber left")
+	}
+
+	h.unsubscribe(h.subscribe("k", func() (func(context.Context) Stream[*partBuffer], string) {
+		runs++
+		return func(context.Context) Stream[*partBuffer] {
+			frames := make(chan Item[*partBuffer])
+			close(frames)
+			return frames
+		}, ""
+	}))
+	if runs != 2 {
+		t.Errorf("%d runs, want a new run after the last subscriber left", runs)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const maxIngestPartSize = 1 << 20
+
+// ingestHandler serves POST /ingest. The body is multipart/mixed with parts in
+// the same shape /stream sends, e.g. {"type":"comment","c1":{...},"c2":{...}}.
+// Each part is applied to the store as it is read and acknowledged with a part
+// of its own, so a client can keep sending while reading the replies.
+func ingestHandler(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" || params["boundary"] == "" {
+		http.Error(w, "ingest requests must be multipart/mixed with a boundary", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// HTTP/1.x servers stop reading the body once the response starts unless
+	// told otherwise. HTTP/2 is always full duplex.
+	err = http.NewResponseController(w).EnableFullDuplex()
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		fmt.Println("Error enabling full duplex:", err)
+	}
+
+	pw, ok := newPartWriter(w, r)
+	if !ok {
+		return
+	}
+
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	for n := 1; ; n++ {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			sendIngestResult(pw, n, "", nil, fmt.Errorf("invalid multipart body: %w", err))
+			break
+		}
+		contentID := strings.Trim(part.Header.Get("Content-ID"), "<>")
+		entity, ids, version, err := ingestPart(part)
+		sendIngestResult(pw, n, contentID, map[string]any{"entity": entity, "ids": ids, "version": version}, err)
+	}
+	if r.Context().Err() != nil {
+		return
+	}
+	pw.close()
+}
+
+// ingestPart decodes one part and applies it. It returns the entity type, the
+// ids written and the version they were written at.
+func ingestPart(part *multipart.Part) (string, []string, uint64, error) {
+	if ct, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); ct != "application/json" {
+		return "", nil, 0, fmt.Errorf("part has Content-Type %q, want application/json", ct)
+	}
+
+	var fields map[string]json.RawMessage
+	dec := json.NewDecoder(io.LimitReader(part, maxIngestPartSize))
+	if err := dec.Decode(&fields); err != nil {
+		return "", nil, 0, fmt.Errorf("invalid JSON: %w", err)
+	}
+	var entity string
+	if err := json.Unmarshal(fields["type"], &entity); err != nil {
+		return "", nil, 0, errors.New(`part has no "type"`)
+	}
+	delete(fields, "type")
+
+	ids := make([]string, 0, len(fields))
+	for id := range fields {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	version, err := putEntities(entity, fields)
+	if err != nil {
+		return entity, nil, 0, err
+	}
+	return entity, ids, version, nil
+}
+
+func sendIngestResult(pw *partWriter, n int, contentID string, fields map[string]any, err error) {
+	result := map[string]any{"type": "ack", "part": n}
+	if err != nil {
+		result = map[string]any{"type": "error", "part": n, "error": err.Error()}
+		var conflict *conflictError
+		if errors.As(err, &conflict) {
+			result["status"] = http.StatusPreconditionFailed
+		}
+	} else {
+		for k, v := range fields {
+			result[k] = v
+		}
+	}
+	resultJSON, _ := json.Marshal(result)
+	header := http.Header{"Content-Type": {"application/json"}}
+	if contentID != "" {
+		header.Set("Content-ID", "<"+contentID+">")
+	}
+	pw.writePart(header, resultJSON)
+}
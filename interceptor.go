@@ -0,0 +1,268 @@
+package main
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// part is a part on its way to the client.
+type part struct {
+	Header http.Header
+	Body   []byte
+}
+
+// interceptor sees the parts of a response before they are written. Parts
+// reach it in the order they are written, one at a time.
+type interceptor interface {
+	// intercept passes p on by calling next, possibly several times or with
+	// other parts. Not calling next drops it.
+	intercept(p part, next func(part))
+	// end is called before the response ends and may add parts with next.
+	end(next func(part))
+}
+
+// interceptorKinds are the interceptors -intercept can name. Each response
+// gets its own instances.
+var interceptorKinds = map[string]func(route string) interceptor{
+	"metrics":  func(route string) interceptor { return &metricsInterceptor{route: route} },
+	"redact":   func(string) interceptor { return redactInterceptor{} },
+	"sign":     func(string) interceptor { return signInterceptor{} },
+	"envelope": func(string) interceptor { return &envelopeInterceptor{} },
+}
+
+// routeInterceptors holds the interceptors of each route, in order, set with
+// -intercept.
+var routeInterceptors = interceptorFlags{}
+
+type interceptorFlags map[string][]string
+
+func (f interceptorFlags) String() string {
+	routes := make([]string, 0, len(f))
+	for route := range f {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	specs := make([]string, len(routes))
+	for i, route := range routes {
+		specs[i] = route + "=" + strings.Join(f[route], ",")
+	}
+	return strings.Join(specs, " ")
+}
+
+// Set parses route=name,... where route is a path pattern such as
+// /posts/{id}/stream.
+func (f interceptorFlags) Set(spec string) error {
+	route, names, ok := strings.Cut(spec, "=")
+	if !ok || !strings.HasPrefix(route, "/") || names == "" {
+		return fmt.Errorf("invalid interceptors %q, want route=name,...", spec)
+	}
+	for _, name := range strings.Split(names, ",") {
+		if _, ok := interceptorKinds[name]; !ok {
+			return fmt.Errorf("unknown interceptor %q", name)
+		}
+	}
+	f[route] = strings.Split(names, ",")
+	return nil
+}
+
+// validate checks the settings the interceptors depend on, once all flags are
+// parsed.
+func (f interceptorFlags) validate() error {
+	for route, names := range f {
+		if slices.Contains(names, "sign") && len(signKey) == 0 {
+			return fmt.Errorf("%s signs parts but -sign-key is not set", route)
+		}
+	}
+	return nil
+}
+
+// interceptorChain runs the parts of one response through the interceptors of
+// its route. A part an interceptor passes on goes through the rest of the
+// chain before the interceptor sees the next one, so parts keep their order.
+type interceptorChain struct {
+	stages []interceptor
+	write  func(part)
+}
+
+// newInterceptorChain returns the chain of the route r was matched with, or
+// nil if it has none.
+func newInterceptorChain(r *http.Request, write func(part)) *interceptorChain {
+	route := r.Pattern
+	if _, p, ok := strings.Cut(route, " "); ok {
+		route = p
+	}
+	names := routeInterceptors[route]
+	if len(names) == 0 {
+		return nil
+	}
+	c := &interceptorChain{write: write}
+	for _, name := range names {
+		c.stages = append(c.stages, interceptorKinds[name](route))
+	}
+	return c
+}
+
+// next returns the function that sends a part into stage i.
+func (c *interceptorChain) next(i int) func(part) {
+	if i == len(c.stages) {
+		return c.write
+	}
+	return func(p part) { c.stages[i].intercept(p, c.next(i+1)) }
+}
+
+func (c *interceptorChain) send(p part) {
+	c.next(0)(p)
+}
+
+// end ends each stage in turn; the parts a stage adds go through the stages
+// after it.
+func (c *interceptorChain) end() {
+	for i, s := range c.stages {
+		s.end(c.next(i + 1))
+	}
+}
+
+// isJSON reports whether a part has a JSON body, patches included.
+func (p part) isJSON() bool {
+	mediaType, _, err := mime.ParseMediaType(cmp.Or(p.Header.Get("Content-Type"), "application/json"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+var (
+	interceptedParts     = expvar.NewMap("stream_parts")
+	interceptedPartBytes = expvar.NewMap("stream_part_bytes")
+)
+
+// metricsInterceptor counts the parts and bytes of its route by part type at
+// /debug/vars, e.g. "/stream post".
+type metricsInterceptor struct {
+	route string
+}
+
+func (m *metricsInterceptor) intercept(p part, next func(part)) {
+	var typed struct {
+		Type string `json:"type"`
+	}
+	if p.isJSON() {
+		json.Unmarshal(p.Body, &typed)
+	}
+	key := m.route + " " + cmp.Or(typed.Type, "other")
+	interceptedParts.Add(key, 1)
+	interceptedPartBytes.Add(key, int64(len(p.Body)))
+	next(p)
+}
+
+func (m *metricsInterceptor) end(func(part)) {}
+
+// redactFields are the JSON fields redact hides, set with -redact.
+var redactFields = listFlag{"name"}
+
+// redactInterceptor replaces the values of redactFields, at any depth, with
+// "[redacted]". JSON Patch operations on those fields are redacted too.
+type redactInterceptor struct{}
+
+func (redactInterceptor) intercept(p part, next func(part)) {
+	var v any
+	if !p.isJSON() || json.Unmarshal(p.Body, &v) != nil || !redact(v) {
+		next(p)
+		return
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		fmt.Println("Error marshalling redacted part:", err)
+		return
+	}
+	next(part{Header: p.Header, Body: body})
+}
+
+func (redactInterceptor) end(func(part)) {}
+
+// redact redacts v in place and reports whether it changed anything.
+func redact(v any) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]any:
+		if p, ok := v["path"].(string); ok && slices.Contains(redactFields, path.Base(p)) {
+			if _, ok := v["value"]; ok {
+				v["value"], changed = "[redacted]", true
+			}
+		}
+		for k, field := range v {
+			if slices.Contains(redactFields, k) {
+				v[k], changed = "[redacted]", true
+			} else if redact(field) {
+				changed = true
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if redact(item) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// signKey is the secret signInterceptor signs with, set with -sign-key.
+var signKey []byte
+
+// signInterceptor adds X-Signature: sha256=<hex HMAC-SHA256 of the body>, so
+// clients holding the key can check a part was not altered.
+type signInterceptor struct{}
+
+func (signInterceptor) intercept(p part, next func(part)) {
+	mac := hmac.New(sha256.New, signKey)
+	mac.Write(p.Body)
+	header := p.Header.Clone()
+	header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	next(part{Header: header, Body: p.Body})
+}
+
+func (signInterceptor) end(func(part)) {}
+
+// envelopeInterceptor wraps JSON bodies as {"seq":n,"body":...}, numbering
+// them from 1. A body that is not plain JSON keeps its media type in
+// contentType, and the part becomes application/json.
+type envelopeInterceptor struct {
+	seq int
+}
+
+type envelope struct {
+	Seq         int             `json:"seq"`
+	ContentType string          `json:"contentType,omitempty"`
+	Body        json.RawMessage `json:"body"`
+}
+
+func (e *envelopeInterceptor) intercept(p part, next func(part)) {
+	if !p.isJSON() {
+		next(p)
+		return
+	}
+	e.seq++
+	env := envelope{Seq: e.seq, Body: p.Body}
+	if ct := p.Header.Get("Content-Type"); ct != "" && ct != "application/json" {
+		env.ContentType = ct
+	}
+	body, err := json.Marshal(env)
+	if err != nil {
+		fmt.Println("Error marshalling envelope:", err)
+		return
+	}
+	header := p.Header.Clone()
+	header.Set("Content-Type", "application/json")
+	next(part{Header: header, Body: body})
+}
+
+func (e *envelopeInterceptor) end(func(part)) {}
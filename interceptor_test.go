@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useInterceptors routes /test through the named interceptors, registering
+// the extra kinds for the test.
+func useInterceptors(t *testing.T, names []string, extra map[string]interceptor) {
+	t.Helper()
+	for name, ic := range extra {
+		interceptorKinds[name] = func(string) interceptor { return ic }
+	}
+	routeInterceptors["/test"] = names
+	t.Cleanup(func() {
+		for name := range extra {
+			delete(interceptorKinds, name)
+		}
+		delete(routeInterceptors, "/test")
+	})
+}
+
+// interceptedResponse writes parts with write through the /test chain and
+// returns the response.
+func interceptedResponse(t *testing.T, write func(pw *partWriter)) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/test", nil)
+	r.Pattern = "GET /test"
+	w := httptest.NewRecorder()
+	pw, ok := newPartWriter(w, r)
+	if !ok {
+		t.Fatal("cannot stream")
+	}
+	write(pw)
+	pw.close()
+	return w
+}
+
+// readParts returns the parts of a multipart/mixed response.
+func readParts(t *testing.T, w *httptest.ResponseRecorder) []part {
+	t.Helper()
+	mr := multipart.NewReader(w.Body, boundary)
+	var parts []part
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, part{Header: http.Header(p.Header), Body: body})
+	}
+}
+
+func bodies(parts []part) []string {
+	out := make([]string, len(parts))
+	for i, p := range parts {
+		out[i] = string(p.Body)
+	}
+	return out
+}
+
+// splitInterceptor sends a part whose body is a JSON array as one part per
+// element.
+type splitInterceptor struct{}
+
+func (splitInterceptor) intercept(p part, next func(part)) {
+	body := string(p.Body)
+	if !strings.HasPrefix(body, "[") {
+		next(p)
+		return
+	}
+	for _, element := range strings.Split(strings.Trim(body, "[]"), ",") {
+		next(part{Header: p.Header, Body: []byte(element)})
+	}
+}
+
+func (splitInterceptor) end(func(part)) {}
+
+// countInterceptor adds a part with the number of parts it saw at the end.
+type countInterceptor struct{ n int }
+
+func (c *countInterceptor) intercept(p part, next func(part)) {
+	c.n++
+	next(p)
+}
+
+func (c *countInterceptor) end(next func(part)) {
+	next(part{Header: http.Header{"Content-Type": {"application/json"}}, Body: fmt.Appendf(nil, `{"type":"count","n":%d}`, c.n)})
+}
+
+// recordInterceptor keeps the bodies it sees.
+type recordInterceptor struct{ seen []string }
+
+func (r *recordInterceptor) intercept(p part, next func(part)) {
+	r.seen = append(r.seen, string(p.Body))
+	next(p)
+}
+
+func (r *recordInterceptor) end(func(part)) {}
+
+func TestInterceptorSplitAndInject(t *testing.T) {
+	record := &recordInterceptor{}
+	useInterceptors(t, []string{"split", "count", "record"}, map[string]interceptor{
+		"split":  splitInterceptor{},
+		"count":  &countInterceptor{},
+		"record": record,
+	})
+	w := interceptedResponse(t, func(pw *partWriter) {
+		pw.sendJSON(map[string]string{"type": "first"})
+		pw.sendJSON([]int{1, 2, 3})
+		pw.sendPart(`{"type":"last"}`)
+	})
+	want := []string{`{"type":"first"}`, "1", "2", "3", `{"type":"last"}`, `{"type":"count","n":5}`}
+	if got := bodies(readParts(t, w)); !reflect.DeepEqual(got, want) {
+		t.Errorf("parts = %q, want %q", got, want)
+	}
+	// Parts a stage adds at the end still go through the stages after it.
+	if !reflect.DeepEqual(record.seen, want) {
+		t.Errorf("last stage saw %q, want %q", record.seen, want)
+	}
+}
+
+func TestInterceptorDrop(t *testing.T) {
+	useInterceptors(t, []string{"drop"}, map[string]interceptor{"drop": dropInterceptor{}})
+	w := interceptedResponse(t, func(pw *partWriter) {
+		pw.sendPart(`{"type":"keep"}`)
+		pw.sendPart(`{"type":"drop"}`)
+	})
+	if got, want := bodies(readParts(t, w)), []string{`{"type":"keep"}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parts = %q, want %q", got, want)
+	}
+}
+
+type dropInterceptor struct{}
+
+func (dropInterceptor) intercept(p part, next func(part)) {
+	if !strings.Contains(string(p.Body), "drop") {
+		next(p)
+	}
+}
+
+func (dropInterceptor) end(func(part)) {}
+
+// Interceptors see the parts as encoded, not parsed back from the framing, so
+// a body that looks like a boundary cannot split a part.
+func TestInterceptorBodyWithBoundary(t *testing.T) {
+	record := &recordInterceptor{}
+	useInterceptors(t, []string{"record"}, map[string]interceptor{"record": record})
+	body := "before\r\n--" + boundary + "\r\nContent-Type: text/plain\r\n\r\nafter"
+	interceptedResponse(t, func(pw *partWriter) {
+		pw.writePart(http.Header{"Content-Type": {"text/plain"}}, []byte(body))
+		pw.sendJSON(map[string]string{"type": "next"})
+	})
+	if want := []string{body, `{"type":"next"}`}; !reflect.DeepEqual(record.seen, want) {
+		t.Errorf("seen = %q, want %q", record.seen, want)
+	}
+}
+
+// Parts encoded together, as a transform with several outputs does, and
+// replayed by a shared run are still seen one at a time with their headers.
+func TestInterceptorEncodedParts(t *testing.T) {
+	record := &recordInterceptor{}
+	useInterceptors(t, []string{"record"}, map[string]interceptor{"record": record})
+	batch := []Item[any]{{Type: "post", ID: "p1", Value: Post{ID: "p1"}}}
+	f, err := parseTransform(".type, .p1.id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := encodeTransformed(boundary, batch, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := &hub{streams: make(map[string]*broadcast)}
+	run := hub.subscribe("test", func() (func(context.Context) Stream[*partBuffer], string) {
+		return func(context.Context) Stream[*partBuffer] {
+			out := make(chan Item[*partBuffer], 1)
+			out <- Item[*partBuffer]{Type: "post", Value: b}
+			close(out)
+			return out
+		}, ""
+	})
+	defer hub.unsubscribe(run)
+	w := interceptedResponse(t, func(pw *partWriter) {
+		if err := run.follow(t.Context(), pw); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if want := []string{`"post"`, `"p1"`}; !reflect.DeepEqual(record.seen, want) {
+		t.Errorf("seen = %q, want %q", record.seen, want)
+	}
+	for _, p := range readParts(t, w) {
+		if p.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("part %q has Content-Type %q", p.Body, p.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestMetricsInterceptor(t *testing.T) {
+	useInterceptors(t, []string{"metrics"}, nil)
+	count := func(m *expvar.Map, key string) int64 {
+		if v, ok := m.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	posts, postBytes := count(interceptedParts, "/test post"), count(interceptedPartBytes, "/test post")
+	others := count(interceptedParts, "/test other")
+	interceptedResponse(t, func(pw *partWriter) {
+		pw.sendPart(`{"type":"post","id":"p1"}`)
+		pw.sendPart(`{"type":"post","id":"p2"}`)
+		pw.writePart(http.Header{"Content-Type": {"text/plain"}}, []byte("hello"))
+	})
+	if got := count(interceptedParts, "/test post") - posts; got != 2 {
+		t.Errorf("post parts = %d, want 2", got)
+	}
+	if got, want := count(interceptedPartBytes, "/test post")-postBytes, int64(2*len(`{"type":"post","id":"p1"}`)); got != want {
+		t.Errorf("post bytes = %d, want %d", got, want)
+	}
+	if got := count(interceptedParts, "/test other") - others; got != 1 {
+		t.Errorf("other parts = %d, want 1", got)
+	}
+}
+
+func TestRedactInterceptor(t *testing.T) {
+	useInterceptors(t, []string{"redact"}, nil)
+	fields := redactFields
+	redactFields = listFlag{"name", "email"}
+	t.Cleanup(func() { redactFields = fields })
+	patch := http.Header{"Content-Type": {"application/json-patch+json"}}
+	w := interceptedResponse(t, func(pw *partWriter) {
+		pw.sendPart(`{"type":"user","id":"u1","name":"Ann","profile":{"email":"a@example.com"}}`)
+		pw.writePart(patch, []byte(`[{"op":"replace","path":"/name","value":"Bea"},{"op":"replace","path":"/age","value":3}]`))
+		pw.writePart(http.Header{"Content-Type": {"text/plain"}}, []byte(`{"name":"Ann"}`))
+		pw.sendPart(`{"type":"post","id":"p1"}`)
+	})
+	want := []string{
+		`{"id":"u1","name":"[redacted]","profile":{"email":"[redacted]"},"type":"user"}`,
+		`[{"op":"replace","path":"/name","value":"[redacted]"},{"op":"replace","path":"/age","value":3}]`,
+		`{"name":"Ann"}`,
+		`{"type":"post","id":"p1"}`,
+	}
+	if got := bodies(readParts(t, w)); !reflect.DeepEqual(got, want) {
+		t.Errorf("parts = %q, want %q", got, want)
+	}
+}
+
+func TestSignInterceptor(t *testing.T) {
+	useInterceptors(t, []string{"sign"}, nil)
+	key := signKey
+	signKey = []byte("secret")
+	t.Cleanup(func() { signKey = key })
+	w := interceptedResponse(t, func(pw *partWriter) {
+		pw.sendPart(`{"type":"post","id":"p1"}`)
+		pw.writePart(http.Header{"Content-Type": {"text/plain"}}, []byte("hello"))
+	})
+	parts := readParts(t, w)
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(parts))
+	}
+	for _, p := range parts {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(p.Body)
+		if got, want := p.Header.Get("X-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+			t.Errorf("part %q signed %q, want %q", p.Body, got, want)
+		}
+	}
+}
+
+func TestSignWithoutKey(t *testing.T) {
+	key := signKey
+	signKey = nil
+	t.Cleanup(func() { signKey = key })
+	if err := (interceptorFlags{"/stream": {"sign"}}).validate(); err == nil {
+		t.Error("sign without a key was accepted")
+	}
+}
+
+func TestEnvelopeInterceptor(t *testing.T) {
+	useInterceptors(t, []string{"envelope"}, nil)
+	w := interceptedResponse(t, func(pw *partWriter) {
+		pw.sendPart(`{"type":"post","id":"p1"}`)
+		pw.writePart(http.Header{"Content-Type": {"text/plain"}}, []byte("hello"))
+		pw.writePart(http.Header{"Content-Type": {"application/merge-patch+json"}}, []byte(`{"title":"t"}`))
+	})
+	parts := readParts(t, w)
+	want := []string{
+		`{"seq":1,"body":{"type":"post","id":"p1"}}`,
+		"hello",
+		`{"seq":2,"contentType":"application/merge-patch+json","body":{"title":"t"}}`,
+	}
+	if got := bodies(parts); !reflect.DeepEqual(got, want) {
+		t.Fatalf("parts = %q, want %q", got, want)
+	}
+	for i, ct := range []string{"application/json", "text/plain", "application/json"} {
+		if got := parts[i].Header.Get("Content-Type"); got != ct {
+			t.Errorf("part %d has Content-Type %q, want %q", i, got, ct)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type jobStatus string
+
+const (
+	jobQueued    jobStatus = "queued"
+	jobRunning   jobStatus = "running"
+	jobSucceeded jobStatus = "succeeded"
+	jobFailed    jobStatus = "failed"
+	jobCanceled  jobStatus = "canceled"
+)
+
+// job is a table computation running in the background. Every part it
+// produces is kept so watchers that attach late can replay them.
+type job struct {
+	id     string
+	cfg    tableConfig
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	status     jobStatus
+	events     []string
+	changed    chan struct{} // closed and replaced whenever events or status change
+	finishedAt time.Time
+}
+
+func (j *job) done() bool {
+	return j.status == jobSucceeded || j.status == jobFailed || j.status == jobCanceled
+}
+
+// publish appends a part and wakes up watchers.
+func (j *job) publish(payload any) {
+	eventJSON, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Println("Error marshalling job event:", err)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.appendEvent(eventJSON)
+}
+
+// appendEvent adds an encoded part. j.mu must be held.
+func (j *job) appendEvent(eventJSON []byte) {
+	j.events = append(j.events, string(eventJSON))
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// setStatus records a status change and publishes it as a part. It is a no-op
+// once the job is done, so a cancel racing with completion reports only one
+// final status. The part is added together with the status, so a watcher that
+// sees the job done has its final part too.
+func (j *job) setStatus(status jobStatus, errMsg string) {
+	eventJSON, err := json.Marshal(j.statusPart(status, errMsg))
+	if err != nil {
+		fmt.Println("Error marshalling job event:", err)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.done() {
+		return
+	}
+	j.status = status
+	if j.done() {
+		j.finishedAt = time.Now()
+	}
+	j.appendEvent(eventJSON)
+}
+
+func (j *job) statusPart(status jobStatus, errMsg string) map[string]any {
+	part := map[string]any{"type": "status", "job": j.id, "status": status}
+	if errMsg != "" {
+		part["error"] = errMsg
+	}
+	return part
+}
+
+// jobManager queues jobs onto a fixed number of workers and forgets finished
+// jobs once they are older than ttl.
+type jobManager struct {
+	ttl   time.Duration
+	queue chan *job
+
+	mu   sync.Mutex
+	seq  int
+	jobs map[string]*job
+}
+
+func newJobManager(workers int, ttl time.Duration) *jobManager {
+	m := &jobManager{
+		ttl:   ttl,
+		queue: make(chan *job, 100),
+		jobs:  make(map[string]*job),
+	}
+	for range workers {
+		go m.work()
+	}
+	go m.expire()
+	return m
+}
+
+func (m *jobManager) work() {
+	for j := range m.queue {
+		if j.ctx.Err() != nil {
+			continue // canceled while queued
+		}
+		m.run(j)
+	}
+}
+
+func (m *jobManager) run(j *job) {
+	j.setStatus(jobRunning, "")
+	progressEvery := max(1, j.cfg.Rows/20)
+	completed := 0
+	err := computeTable(j.ctx, j.cfg, func(row tableRow) {
+		j.publish(row)
+		completed++
+		if completed%progressEvery == 0 || completed == j.cfg.Rows {
+			j.publish(map[string]any{"type": "progress", "job": j.id, "done": completed, "total": j.cfg.Rows})
+		}
+	})
+	switch {
+	case errors.Is(err, context.Canceled):
+		j.setStatus(jobCanceled, "")
+	case err != nil:
+		j.setStatus(jobFailed, err.Error())
+	default:
+		j.setStatus(jobSucceeded, "")
+	}
+	j.cancel()
+}
+
+func (m *jobManager) expire() {
+	ticker := time.NewTicker(max(m.ttl/2, time.Second))
+	defer ticker.Stop()
+	for range ticker.C {
+		m.removeExpired()
+	}
+}
+
+// removeExpired forgets the jobs that finished more than ttl ago.
+func (m *jobManager) removeExpired() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, j := range m.jobs {
+		j.mu.Lock()
+		expired := j.done() && time.Since(j.finishedAt) > m.ttl
+		j.mu.Unlock()
+		if expired {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+func (m *jobManager) get(id string) *job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jobs[id]
+}
+
+func (m *jobManager) createJob(w http.ResponseWriter, r *http.Request) {
+	cfg := defaultTableConfig()
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "invalid job: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if cfg.Rows < 0 || cfg.Work < 0 || cfg.Variance < 0 || cfg.Variance > 1 {
+		http.Error(w, "invalid job: rows, work and variance out of range", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{cfg: cfg, ctx: ctx, cancel: cancel, status: jobQueued, changed: make(chan struct{})}
+	m.mu.Lock()
+	m.seq++
+	j.id = fmt.Sprintf("job_%d", m.seq)
+	m.mu.Unlock()
+	j.publish(j.statusPart(jobQueued, ""))
+
+	select {
+	case m.queue <- j:
+	default:
+		cancel()
+		http.Error(w, "job queue is full", http.StatusServiceUnavailable)
+		return
+	}
+	m.mu.Lock()
+	m.jobs[j.id] = j
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+j.id+"/stream")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"id": j.id, "status": jobQueued, "stream": "/jobs/" + j.id + "/stream"})
+}
+
+// streamJob replays the parts the job has produced so far, then follows it
+// until it finishes or the client goes away.
+func (m *jobManager) streamJob(w http.ResponseWriter, r *http.Request) {
+	j := m.get(r.PathValue("id"))
+	if j == nil {
+		http.NotFound(w, r)
+		return
+	}
+	pw, ok := newPartWriter(w, r)
+	if !ok {
+		return
+	}
+
+	sent := 0
+	for {
+		j.mu.Lock()
+		events := j.events[sent:]
+		changed := j.changed
+		done := j.done()
+		j.mu.Unlock()
+
+		for _, event := range events {
+			pw.sendPart(event)
+		}
+		sent += len(events)
+		if done {
+			break
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	pw.close()
+}
+
+func (m *jobManager) cancelJob(w http.ResponseWriter, r *http.Request) {
+	j := m.get(r.PathValue("id"))
+	if j == nil {
+		http.NotFound(w, r)
+		return
+	}
+	j.mu.Lock()
+	queued := j.status == jobQueued
+	j.mu.Unlock()
+	j.cancel()
+	if queued {
+		j.setStatus(jobCanceled, "")
+	}
+
+	// A running job stops at its next cancellation check; the final status is
+	// reported on its stream.
+	j.mu.Lock()
+	status, done := j.status, j.done()
+	j.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if !done {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"id": j.id, "status": status})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jobMux routes the job endpoints to a new manager.
+func jobMux(workers int, ttl time.Duration) (*jobManager, *http.ServeMux) {
+	m := newJobManager(workers, ttl)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /jobs", m.createJob)
+	mux.HandleFunc("GET /jobs/{id}/stream", m.streamJob)
+	mux.HandleFunc("DELETE /jobs/{id}", m.cancelJob)
+	return m, mux
+}
+
+func serve(mux *http.ServeMux, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+// createTestJob creates a job and returns the path of its stream.
+func createTestJob(t *testing.T, mux *http.ServeMux, cfg string) string {
+	t.Helper()
+	w := serve(mux, "POST", "/jobs", cfg)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("create: status = %d: %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+// jobParts returns the type of each part of a job stream, with the status for
+// status parts, e.g. "status:queued".
+func jobParts(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var kinds []string
+	for _, p := range readParts(t, w) {
+		var part struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(p.Body, &part); err != nil {
+			t.Fatal(err)
+		}
+		if part.Type == "status" {
+			kinds = append(kinds, "status:"+part.Status)
+		} else {
+			kinds = append(kinds, part.Type)
+		}
+	}
+	return kinds
+}
+
+func TestJobStream(t *testing.T) {
+	_, mux := jobMux(1, time.Minute)
+	stream := createTestJob(t, mux, `{"rows":3,"work":10,"ordered":true}`)
+	if stream == "" {
+		t.Fatal("no Location")
+	}
+	w := serve(mux, "GET", stream, "")
+	body := w.Body.String()
+	want := []string{"status:queued", "status:running", "row", "progress", "row", "progress", "row", "progress", "status:succeeded"}
+	if got := jobParts(t, w); !reflect.DeepEqual(got, want) {
+		t.Errorf("parts = %q, want %q", got, want)
+	}
+
+	// A watcher that comes after the job finished gets every part again.
+	if replay := serve(mux, "GET", stream, ""); replay.Body.String() != body {
+		t.Errorf("replay = %q, want %q", replay.Body, body)
+	}
+}
+
+func TestJobInvalid(t *testing.T) {
+	_, mux := jobMux(1, time.Minute)
+	for _, cfg := range []string{`{"rows":-1}`, `{"variance":2}`, `{`} {
+		if w := serve(mux, "POST", "/jobs", cfg); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", cfg, w.Code, http.StatusBadRequest)
+		}
+	}
+	if w := serve(mux, "GET", "/jobs/job_9/stream", ""); w.Code != http.StatusNotFound {
+		t.Errorf("unknown job: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestJobCancelQueued(t *testing.T) {
+	_, mux := jobMux(0, time.Minute) // no workers, so the job stays queued
+	stream := createTestJob(t, mux, `{"rows":3,"work":10}`)
+	id := strings.Split(stream, "/")[2]
+	w := serve(mux, "DELETE", "/jobs/"+id, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"canceled"`) {
+		t.Errorf("cancel: %d %s", w.Code, w.Body)
+	}
+	if got, want := jobParts(t, serve(mux, "GET", stream, "")), []string{"status:queued", "status:canceled"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parts = %q, want %q", got, want)
+	}
+}
+
+func TestJobCancelRunning(t *testing.T) {
+	_, mux := jobMux(1, time.Minute)
+	stream := createTestJob(t, mux, `{"rows":100000,"work":100000}`)
+	id := strings.Split(stream, "/")[2]
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serve(mux, "GET", stream, "") }()
+	time.Sleep(10 * time.Millisecond)
+	if w := serve(mux, "DELETE", "/jobs/"+id, ""); w.Code != http.StatusAccepted && w.Code != http.StatusOK {
+		t.Errorf("cancel: status = %d", w.Code)
+	}
+	select {
+	case w := <-done:
+		parts := jobParts(t, w)
+		if last := parts[len(parts)-1]; last != "status:canceled" {
+			t.Errorf("last part = %q, want status:canceled", last)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream did not end after the job was canceled")
+	}
+}
+
+func TestJobExpiry(t *testing.T) {
+	m, mux := jobMux(1, 10*time.Millisecond)
+	stream := createTestJob(t, mux, `{"rows":1,"work":1}`)
+	serve(mux, "GET", stream, "") // wait for it to finish
+	m.removeExpired()
+	if w := serve(mux, "GET", stream, ""); w.Code != http.StatusOK {
+		t.Fatalf("job gone before its ttl: status = %d", w.Code)
+	}
+	time.Sleep(20 * time.Millisecond)
+	m.removeExpired()
+	if w := serve(mux, "GET", stream, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expired job: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// Every watcher ends with the final status, however its reads interleave
+// with the job finishing.
+func TestJobWatchersSeeFinalStatus(t *testing.T) {
+	_, mux := jobMux(1, time.Minute)
+	stream := createTestJob(t, mux, `{"rows":50,"work":100}`)
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			parts := jobParts(t, serve(mux, "GET", stream, ""))
+			if last := parts[len(parts)-1]; last != "status:succeeded" {
+				t.Errorf("last part = %q, want status:succeeded", last)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// changeBuffer is how many changes a live stream may fall behind the store
+// before it is ended.
+const changeBuffer = 256
+
+// followChanges sends the changes to the entity types in follow, which start
+// after version from, until ctx is done. If the stream falls too far behind, it
+// ends with an error part naming the version to catch up from with ?since.
+func followChanges(ctx context.Context, changes <-chan change, follow []string, format patchFormat, from uint64, out chan<- Item[*partBuffer]) {
+	// since is the last version all of whose changes were sent; a write can
+	// change several entities under one version.
+	since, current := from, from
+	for {
+		var c change
+		var ok bool
+		select {
+		case c, ok = <-changes:
+		case <-ctx.Done():
+			return
+		}
+		if !ok {
+			fmt.Println("Error following changes: stream fell behind")
+			behind := map[string]any{"type": "error", "error": "stream fell behind", "since": since}
+			if b, err := encodeJSONPart(boundary, nil, func(b *partBuffer) error { return b.encode(behind) }); err == nil {
+				forward(ctx, out, Item[*partBuffer]{Type: "error", Value: b})
+			}
+			return
+		}
+		if c.Version != current {
+			since, current = current, c.Version
+		}
+		if !slices.Contains(follow, c.Entity) {
+			continue
+		}
+		b, err := encodeChange(boundary, c, format)
+		if err != nil {
+			fmt.Printf("Error marshalling %s change: %v\n", c.Entity, err)
+			continue
+		}
+		if b != nil && !forward(ctx, out, Item[*partBuffer]{Type: c.Entity, Value: b}) {
+			return
+		}
+	}
+}
+
+// encodeChange encodes a change as a part: a created entity is sent whole, a
+// deleted one as a tombstone, and an update as a patch to the part whose
+// Content-ID the Content-Location refers to. It returns nil if nothing
+// visible changed.
+func encodeChange(boundary string, c change, format patchFormat) (*partBuffer, error) {
+	switch {
+	case c.Old == nil:
+		return encodeBatch(boundary, []Item[any]{{Type: c.Entity, ID: c.ID, Value: c.New}})
+	case c.New == nil:
+		t := tombstone{Type: "tombstone", Entity: c.Entity, ID: c.ID, Version: c.Version, Cause: c.Cause}
+		return encodeBatch(boundary, []Item[any]{{Type: "tombstone", Value: t}})
+	}
+	patch, err := format.diff(c.Old, c.New)
+	if err != nil || patch == nil {
+		return nil, err
+	}
+	header := http.Header{
+		"Content-Type":     {format.contentType()},
+		"Content-Location": {"cid:" + entityKey(c.Entity, c.ID)},
+	}
+	return encodeJSONPart(boundary, header, func(b *partBuffer) error { return b.encode(patch) })
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/M0rfes/multipart-mixed/client"
+)
+
+// A feed that overflows ends the stream with the version to resume from,
+// which must not skip the rest of a write that was cut short.
+func TestFollowChangesFellBehind(t *testing.T) {
+	changes := make(chan change, 3)
+	changes <- change{Entity: "post", ID: "p9", Version: 5, New: Post{ID: "p9", Version: 5}}
+	changes <- change{Entity: "comment", ID: "c9", Version: 6, New: Comment{ID: "c9", User: "u1", Version: 6}}
+	close(changes)
+
+	out := make(chan Item[*partBuffer], 10)
+	followChanges(context.Background(), changes, []string{"post", "comment"}, jsonPatch, 4, out)
+	close(out)
+	var parts []string
+	for it := range out {
+		parts = append(parts, it.Value.String())
+		it.Value.release()
+	}
+	if len(parts) != 3 {
+		t.Fatalf("got %d parts, want 3: %q", len(parts), parts)
+	}
+	if last := parts[2]; !strings.Contains(last, `"type":"error"`) || !strings.Contains(last, `"since":5`) {
+		t.Errorf("last part = %q, want an error part with since 5", last)
+	}
+}
+
+// A live stream whose snapshot is older than the kept changes cannot follow
+// on from it and must say so rather than quietly not being live.
+func TestLiveStreamChangesNoLongerKept(t *testing.T) {
+	db.mu.Lock()
+	floor := db.logFloor
+	db.logFloor = db.cur.version + 1
+	db.mu.Unlock()
+	defer func() {
+		db.mu.Lock()
+		db.logFloor = floor
+		db.mu.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	streamHandler(w, httptest.NewRequest("GET", "/stream?live=1", nil))
+	if w.Code != http.StatusGone {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusGone)
+	}
+}
+
+// A live stream sends the snapshot and then every write after it exactly
+// once, including the writes made while the snapshot was being sent.
+func TestLiveStreamConcurrentWrites(t *testing.T) {
+	savedDB, savedLatency := db, emitLatency
+	db, emitLatency = newStore(posts, comments, users), 5*time.Millisecond
+	defer func() { db, emitLatency = savedDB, savedLatency }()
+	srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer srv.Close()
+
+	// Each post is written by its own writer, which records the versions.
+	// The writes go on while the stream starts and sends the snapshot.
+	const writes = 20
+	written := make(map[string][]uint64)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range posts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Version = 1
+			for i := range writes {
+				p.Data = fmt.Sprint(i)
+				v, err := db.PutPosts(p)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				p.Version = v
+				mu.Lock()
+				written[p.ID] = append(written[p.ID], v)
+				mu.Unlock()
+				time.Sleep(2 * time.Millisecond)
+			}
+		}()
+	}
+	for db.snapshot().version < uint64(1+2*len(posts)) {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/stream?live=1&patch=merge-patch", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The client applies every part and records the versions each post went
+	// through.
+	entities := make(client.Entities)
+	seen := make(map[string][]uint64)
+	got := make(chan struct{}, 1)
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		mr := multipart.NewReader(resp.Body, boundary)
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+			// A part only ends at the next boundary, so decode the body
+			// rather than wait for the next part.
+			var body json.RawMessage
+			if err := json.NewDecoder(p).Decode(&body); err != nil {
+				if ctx.Err() == nil {
+					t.Error(err)
+				}
+				return
+			}
+			mu.Lock()
+			if err := entities.Apply(p.Header, body); err != nil {
+				t.Error(err)
+			}
+			var keys []string
+			if key, ok := strings.CutPrefix(p.Header.Get("Content-Location"), "cid:"); ok {
+				keys = append(keys, key)
+			} else {
+				var envelope map[string]json.RawMessage
+				json.Unmarshal(body, &envelope)
+				if string(envelope["type"]) == `"post"` {
+					for id := range envelope {
+						if id != "type" {
+							keys = append(keys, "post/"+id)
+						}
+					}
+				}
+			}
+			for _, key := range keys {
+				if post, ok := entities[key].(map[string]any); ok {
+					id := strings.TrimPrefix(key, "post/")
+					seen[id] = append(seen[id], uint64(post["version"].(float64)))
+				}
+			}
+			mu.Unlock()
+			select {
+			case got <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	wg.Wait()
+	final := db.snapshot()
+	caughtUp := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, p := range final.Posts() {
+			s, ok := entities["post/"+p.ID].(map[string]any)
+			if !ok || s["version"] != float64(p.Version) || s["data"] != p.Data {
+				return false
+			}
+		}
+		return true
+	}
+	for !caughtUp() {
+		select {
+		case <-got:
+		case <-ctx.Done():
+			t.Fatalf("stream did not catch up with the writes: %v", seen)
+		}
+	}
+	cancel()
+	<-read
+
+	for id, versions := range seen {
+		// The first version is the snapshot's, then come the later writes.
+		want := []uint64{versions[0]}
+		for _, v := range written[id] {
+			if v > versions[0] {
+				want = append(want, v)
+			}
+		}
+		if !reflect.DeepEqual(versions, want) {
+			t.Errorf("%s went through versions %v, want %v", id, versions, want)
+		}
+	}
+	if len(seen) != len(posts) {
+		t.Errorf("saw %d posts, want %d", len(seen), len(posts))
+	}
+}
+
+// Changes are not scoped to a page, so a live stream of one would patch
+// entities the client never got.
+func TestLiveStreamRejectsPage(t *testing.T) {
+	cursor := pageCursor{After: "p1", Limit: 1}.encode()
+	for _, query := range []string{"limit=1&live=1", "cursor=" + cursor + "&live=1"} {
+		w := httptest.NewRecorder()
+		streamHandler(w, httptest.NewRequest("GET", "/stream?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
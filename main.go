@@ -1,28 +1,38 @@
 package main
 
 import (
-	"encoding/json"
+	"cmp"
+	"context"
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 )
 
+// Each entity carries the store version at which it was last written. Writes
+// must name the version they replace, 0 for a new entity.
 type Post struct {
 	ID       string   `json:"id"`
 	Data     string   `json:"data"`
 	Comments []string `json:"comments"`
+	Version  uint64   `json:"version"`
 }
 
 type Comment struct {
-	ID   string `json:"id"`
-	Text string `json:"text"`
-	User string `json:"user"`
+	ID      string `json:"id"`
+	Text    string `json:"text"`
+	User    string `json:"user"`
+	Version uint64 `json:"version"`
 }
 
 type User struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Version uint64 `json:"version"`
 }
 
 var (
@@ -87,132 +97,513 @@ var (
 	}
 )
 
-func getPosts(ch chan<- string) {
-	for _, post := range posts {
-		postMap := make(map[string]any)
-		postMap["type"] = "post"
-		postMap[post.ID] = post
-		postJSON, err := json.Marshal(postMap)
-		if err != nil {
-			fmt.Println("Error marshalling post:", err)
-			continue
+// view selects the local data a /stream request reads. The id lists scope
+// the view; nil means all of that type.
+type view struct {
+	snap     *snapshot
+	since    uint64 // only entities changed after this version
+	posts    []string
+	comments []string
+	users    []string
+}
+
+func (v view) getPosts(ctx context.Context, offset int, ch chan<- Item[Post]) error {
+	posts := v.snap.PostsSince(v.since)
+	if v.posts != nil {
+		posts = inScope(posts, v.posts, func(p Post) string { return p.ID })
+	}
+	for _, post := range posts[min(offset, len(posts)):] {
+		if err := emit(ctx, ch, Item[Post]{Type: "post", ID: post.ID, Value: post}); err != nil {
+			return err
 		}
-		time.Sleep(500 * time.Millisecond)
-		ch <- string(postJSON)
 	}
-	close(ch)
+	return nil
 }
 
-func getComments(ch chan<- string) {
-	for i := 0; i < len(comments); i += 2 {
-		commentMap := make(map[string]any)
-		commentMap["type"] = "comment"
-		commentMap[comments[i].ID] = comments[i]
-		commentMap[comments[i+1].ID] = comments[i+1]
-		commentJSON, err := json.Marshal(commentMap)
-		if err != nil {
-			fmt.Println("Error marshalling comments:", err)
-			continue
+func (v view) getComments(ctx context.Context, offset int, ch chan<- Item[Comment]) error {
+	comments := v.snap.CommentsSince(v.since)
+	if v.comments != nil {
+		comments = inScope(comments, v.comments, func(c Comment) string { return c.ID })
+	}
+	for _, comment := range comments[min(offset, len(comments)):] {
+		if err := emit(ctx, ch, Item[Comment]{Type: "comment", ID: comment.ID, Value: comment}); err != nil {
+			return err
 		}
-		time.Sleep(500 * time.Millisecond)
-		ch <- string(commentJSON)
 	}
-	close(ch)
+	return nil
 }
 
-func getUsers(ch chan<- string) {
-	for i := 0; i < len(users); i += 1 {
-		userMap := make(map[string]any)
-		userMap["type"] = "user"
-		userMap[users[i].ID] = users[i]
-		userJSON, err := json.Marshal(userMap)
-		if err != nil {
-			fmt.Println("Error marshalling users:", err)
-			continue
+func (v view) getUsers(ctx context.Context, offset int, ch chan<- Item[User]) error {
+	users := v.snap.UsersSince(v.since)
+	if v.users != nil {
+		users = inScope(users, v.users, func(u User) string { return u.ID })
+	}
+	for _, user := range users[min(offset, len(users)):] {
+		if err := emit(ctx, ch, Item[User]{Type: "user", ID: user.ID, Value: user}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getTombstones sends the deletions since the view's version. They are control
+// parts, so they have no id and are never batched.
+func (v view) getTombstones(ctx context.Context, offset int, ch chan<- Item[tombstone]) error {
+	tombstones := v.snap.TombstonesSince(v.since)
+	for _, t := range tombstones[min(offset, len(tombstones)):] {
+		if err := emit(ctx, ch, Item[tombstone]{Type: "tombstone", Value: t}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scopeToPosts limits v to the posts, their comments and the users of those
+// comments.
+func (v view) scopeToPosts(ids []string) view {
+	v.posts, v.comments, v.users = ids, []string{}, []string{}
+	for _, id := range ids {
+		if p, ok := v.snap.get("post", id); ok {
+			v.comments = append(v.comments, p.(Post).Comments...)
+		}
+	}
+	for _, id := range v.comments {
+		if c, ok := v.snap.get("comment", id); ok {
+			v.users = append(v.users, c.(Comment).User)
+		}
+	}
+	return v
+}
+
+// scopeToUser limits v to the user, their comments and the posts those are
+// on.
+func (v view) scopeToUser(id string) view {
+	v.users, v.comments, v.posts = []string{id}, []string{}, []string{}
+	for _, c := range v.snap.Comments() {
+		if c.User == id {
+			v.comments = append(v.comments, c.ID)
+		}
+	}
+	for _, p := range v.snap.Posts() {
+		if slices.ContainsFunc(p.Comments, func(cid string) bool { return slices.Contains(v.comments, cid) }) {
+			v.posts = append(v.posts, p.ID)
+		}
+	}
+	return v
+}
+
+// inScope returns the items whose ids are in scope, in the order of scope.
+func inScope[T any](items []T, scope []string, id func(T) string) []T {
+	order := make(map[string]int, len(scope))
+	for i, s := range scope {
+		if _, ok := order[s]; !ok {
+			order[s] = i
 		}
-		time.Sleep(500 * time.Millisecond)
-		ch <- string(userJSON)
 	}
-	close(ch)
+	var scoped []T
+	for _, item := range items {
+		if _, ok := order[id(item)]; ok {
+			scoped = append(scoped, item)
+		}
+	}
+	slices.SortStableFunc(scoped, func(a, b T) int { return cmp.Compare(order[id(a)], order[id(b)]) })
+	return scoped
+}
+
+// emitLatency is the simulated latency of a local producer, per part.
+var emitLatency = 500 * time.Millisecond
+
+// emit waits out the simulated latency of a local producer and sends the part.
+func emit[T any](ctx context.Context, ch chan<- Item[T], it Item[T]) error {
+	select {
+	case <-time.After(emitLatency):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case ch <- it:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func streamHandler(w http.ResponseWriter, r *http.Request) {
+	budget, err := parseBudget(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resume, err := decodeResume(r.URL.Query().Get("resume"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Every source reads the same version of the data.
+	v := view{snap: db.snapshot()}
+	if since := r.URL.Query().Get("since"); since != "" {
+		if v.since, err = strconv.ParseUint(since, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid since %q", since), http.StatusBadRequest)
+			return
+		}
+	}
+	page, paged, err := parsePage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var trailer any
+	if paged {
+		ids, pageTrailer, err := v.snap.page(page)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v, trailer = v.scopeToPosts(ids), pageTrailer
+	}
+	aggregates, err := parseAggregates(r.URL.Query().Get("aggregate"), v.snap)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	live := r.URL.Query().Get("live")
+	if live != "" && live != "0" && live != "1" {
+		http.Error(w, fmt.Sprintf("invalid live %q, want 0 or 1", live), http.StatusBadRequest)
+		return
+	}
+	if live == "1" && paged {
+		// Later changes are to every post, not only those of the page.
+		http.Error(w, "limit and cursor cannot be used with live", http.StatusBadRequest)
+		return
+	}
+	if live == "1" && aggregates != nil {
+		// Aggregates count the comments of the snapshot, not later changes.
+		http.Error(w, "aggregate cannot be used with live", http.StatusBadRequest)
+		return
+	}
+	format, err := parsePatchFormat(r.URL.Query().Get("patch"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var t transform
+	if expr := r.URL.Query().Get("transform"); expr != "" {
+		if live == "1" {
+			// Patches refer to entities as stored, not as transformed.
+			http.Error(w, "transform cannot be used with live", http.StatusBadRequest)
+			return
+		}
+		if t, err = parseTransform(expr); err != nil {
+			http.Error(w, fmt.Sprintf("invalid transform: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if resume != nil && resume.stale(v.snap) {
+		http.Error(w, "the data has changed since the resume cursor was issued", http.StatusGone)
+		return
+	}
+	sources := streamSources(r, v)
+	if paged {
+		// The local posts are already those of the page, but an upstream
+		// source knows nothing of pages.
+		for i, src := range sources {
+			if src.Name == "post" {
+				sources[i] = Limit(src, page.Limit)
+			}
+		}
+	}
+	opts := streamOptions{budget: budget, resume: resume, trailer: trailer, aggregates: aggregates, from: v.snap.version, patch: format, transform: t}
+	if live == "1" {
+		opts.follow = localEntities(sources)
+	}
+	// A live stream goes on past the snapshot, so it has no ETag. Nor does one
+	// with a budget, which may stop short of it: a client must not keep a
+	// truncated copy as current.
+	if etag, version, ok := streamETag(r, sources, v.snap); ok && opts.follow == nil {
+		w.Header().Set("X-Data-Version", strconv.FormatUint(version, 10))
+		if budget == 0 {
+			w.Header().Set("ETag", etag)
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+	opts.priority, err = parsePriority(r.URL.Query().Get("priority"), sources)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var replayPacing bool
+	switch pacing := r.URL.Query().Get("pacing"); pacing {
+	case "", "none":
+	case "replay":
+		replayPacing = true
+	default:
+		http.Error(w, fmt.Sprintf("invalid pacing %q, want none or replay", pacing), http.StatusBadRequest)
+		return
+	}
 
-	boundary := "boundary123abc"
-	w.Header().Set("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%s", boundary))
-	w.Header().Set("Transfer-Encoding", "chunked")
-	w.WriteHeader(200)
+	// A live stream does not end, so it is not shared: a broadcast keeps every
+	// part for late joiners. It reads the snapshot directly, not the cache.
+	if opts.follow != nil {
+		changes, unsubscribe, err := db.subscribe(v.snap.version, changeBuffer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		defer unsubscribe()
+		opts.changes = changes
+		serveStream(w, r, sources, opts)
+		return
+	}
+
+	// Identical requests of the same version share one run of the producers.
+	key := streamKey(r) + "\nversion: " + strconv.FormatUint(v.snap.version, 10)
+	b := streamHub.subscribe(key, func() (func(context.Context) Stream[*partBuffer], string) {
+		sources, cacheStatus := cache.wrap(sources, r, v.snap.version, replayPacing)
+		return func(ctx context.Context) Stream[*partBuffer] {
+			return openStream(ctx, sources, opts)
+		}, cacheStatus
+	})
+	defer streamHub.unsubscribe(b)
+	if b.cacheStatus != "" {
+		w.Header().Set("X-Cache", b.cacheStatus)
+	}
 
-	flusher, ok := w.(http.Flusher)
+	pw, ok := newPartWriter(w, r)
 	if !ok {
-		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
 		return
 	}
+	if err := b.follow(r.Context(), pw); err != nil {
+		abortSlowClient(r, err)
+		return
+	}
+	pw.close()
+}
 
+// streamOptions are the per-request settings of openStream.
+type streamOptions struct {
+	priority   []string
+	budget     time.Duration
+	resume     *resumeCursor
+	trailer    any           // if not nil, the last part of the snapshot
+	ordered    bool          // send each source's parts in turn instead of interleaving them
+	aggregates []aggregate   // counted over the comments sent
+	follow     []string      // entity types whose changes follow the snapshot
+	changes    <-chan change // the feed of changes after the snapshot, if follow is set
+	from       uint64        // version of the snapshot the local sources read
+	patch      patchFormat   // how followed updates are sent
+	transform  transform     // if not nil, applied to the body of every source part
+}
+
+// openStream runs the sources and returns the encoded parts in the order they
+// should be sent, then opts.trailer. If the budget runs out first, the summary
+// comes before the trailer.
+// When opts.follow is set, the stream then goes on with opts.changes, until ctx
+// is done.
+func openStream(ctx context.Context, sources []Source[any], opts streamOptions) Stream[*partBuffer] {
+	ctx, cancel := context.WithCancelCause(ctx)
+	srcCtx, cancelSources := ctx, context.CancelFunc(func() {})
+	if opts.budget > 0 {
+		srcCtx, cancelSources = context.WithTimeout(ctx, opts.budget)
+	}
+
+	names := make([]string, len(sources))
+	for i, src := range sources {
+		names[i] = src.Name
+	}
+	sched := newScheduler(names, opts.priority, sourceWeights, streamBuffer,
+		func(it Item[*partBuffer]) int { return it.Value.Len() },
+		func(it Item[*partBuffer]) { it.Value.release() })
+	progress := make(map[string]sourceProgress)
 	var mu sync.Mutex
-	sendPart := func(jsonPayload string) {
-		mu.Lock()
-		defer mu.Unlock()
-		fmt.Fprintf(w, "--%s\r\n", boundary)
-		fmt.Fprint(w, "Content-Type: application/json\r\n\r\n")
-		fmt.Fprint(w, jsonPayload)
-		fmt.Fprint(w, "\r\n")
-		flusher.Flush()
-		time.Sleep(1 * time.Millisecond)
-	}
-
-	postCh := make(chan string)
-	commentCh := make(chan string)
-	userCh := make(chan string)
-	go getPosts(postCh)
-	go getComments(commentCh)
-	go getUsers(userCh)
-
-	doneCh := make(chan bool)
+	var wg sync.WaitGroup
+	streams := make(map[string]Stream[*partBuffer])
+	for _, src := range sources {
+		offset, ok := opts.resume.offset(src.Name)
+		if !ok {
+			continue
+		}
+		itemCh := make(chan Item[any])
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(itemCh)
+			delivered, complete := runSource(srcCtx, src, offset, itemCh)
+			mu.Lock()
+			progress[src.Name] = sourceProgress{Delivered: delivered, Complete: complete}
+			mu.Unlock()
+		}()
+
+		// Parts are encoded here, one goroutine per source, so the writer only
+		// copies bytes.
+		// Followed entities are sent one per part, so patches can refer to
+		// them.
+		policy := batchPolicies.get(src.Name)
+		if opts.follow != nil {
+			policy = batchPolicy{maxItems: 1}
+		}
+		batches := Batch(ctx, itemCh, policy, func(it Item[any]) bool { return it.ID != "" })
+		if src.Name == "comment" && opts.aggregates != nil {
+			batches = FlatMap(ctx, batches, countComments(opts.aggregates))
+		}
+		frames := Map(ctx, batches, func(it Item[[]Item[any]]) Item[*partBuffer] {
+			var b *partBuffer
+			var err error
+			if opts.transform != nil {
+				b, err = encodeTransformed(boundary, it.Value, opts.transform)
+			} else {
+				b, err = encodeBatch(boundary, it.Value)
+			}
+			if err != nil {
+				fmt.Printf("Error marshalling %s part: %v\n", src.Name, err)
+			}
+			return Item[*partBuffer]{Type: it.Type, Value: b}
+		})
+		streams[src.Name] = Filter(ctx, frames, func(it Item[*partBuffer]) bool { return it.Value != nil })
+	}
 
+	out := make(chan Item[*partBuffer])
 	go func() {
-		postClosed := false
-		commentClosed := false
-		userClosed := false
-
-		for !postClosed || !commentClosed || !userClosed {
-			select {
-			case post, ok := <-postCh:
-				if !ok {
-					postClosed = true
-				} else {
-					sendPart(post)
-				}
-			case comment, ok := <-commentCh:
-				if !ok {
-					commentClosed = true
-				} else {
-					sendPart(comment)
+		defer close(out)
+		defer cancel(nil)
+		defer cancelSources()
+		var merged Stream[*partBuffer]
+		if opts.ordered {
+			inOrder := make([]Stream[*partBuffer], 0, len(streams))
+			for _, src := range sources {
+				if s, ok := streams[src.Name]; ok {
+					inOrder = append(inOrder, s)
 				}
-			case user, ok := <-userCh:
-				if !ok {
-					userClosed = true
-				} else {
-					sendPart(user)
+			}
+			merged = Concat(ctx, inOrder...)
+		} else {
+			merged = Merge(ctx, sched, streams, cancel)
+		}
+		for frame := range merged {
+			if !forward(ctx, out, frame) {
+				return
+			}
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return
+		}
+		if srcCtx.Err() != nil {
+			if summary, truncated := budgetSummary(opts.budget, opts.from, progress); truncated {
+				b, err := encodeJSONPart(boundary, nil, func(b *partBuffer) error { return b.encode(summary) })
+				if err != nil {
+					fmt.Println("Error marshalling summary:", err)
+				} else if !forward(ctx, out, Item[*partBuffer]{Type: "summary", Value: b}) {
+					return
 				}
 			}
 		}
-		doneCh <- true
+		if opts.trailer != nil {
+			b, err := encodeJSONPart(boundary, nil, func(b *partBuffer) error { return b.encode(opts.trailer) })
+			if err != nil {
+				fmt.Println("Error marshalling trailer:", err)
+			} else if !forward(ctx, out, Item[*partBuffer]{Type: "trailer", Value: b}) {
+				return
+			}
+		}
+		if opts.changes != nil {
+			followChanges(ctx, opts.changes, opts.follow, opts.patch, opts.from, out)
+		}
 	}()
+	return out
+}
 
-	<-doneCh
-	fmt.Fprintf(w, "--%s--\r\n", boundary)
-	flusher.Flush()
+// serveStream runs the sources and writes their parts as the response.
+func serveStream(w http.ResponseWriter, r *http.Request, sources []Source[any], opts streamOptions) {
+	writeStream(w, r, openStream(r.Context(), sources, opts))
+}
+
+// writeStream writes encoded parts as the response, as they come.
+func writeStream(w http.ResponseWriter, r *http.Request, frames Stream[*partBuffer]) {
+	pw, ok := newPartWriter(w, r)
+	if !ok {
+		return
+	}
+	for frame := range frames {
+		pw.writeFrame(frame.Value)
+		if pw.err != nil {
+			abortSlowClient(r, pw.err)
+			return
+		}
+	}
+	if r.Context().Err() != nil {
+		return
+	}
+	pw.close()
 }
 
 func main() {
+	jobWorkers := flag.Int("job-workers", 2, "number of jobs that run concurrently")
+	jobTTL := flag.Duration("job-ttl", 10*time.Minute, "how long finished jobs are kept")
+	flag.Var(&upstreams, "upstream", "fetch a source from an upstream instead of the local data, as name=format:url[;timeout=5s] where format is json, ndjson or multipart (repeatable)")
+	flag.Var(&forwardHeaders, "forward-header", "request header to forward to upstreams (repeatable)")
+	flag.DurationVar(&policy.timeout, "source-timeout", policy.timeout, "deadline for each /stream source, including retries")
+	flag.IntVar(&policy.retries, "source-retries", policy.retries, "how many times a failed source is retried")
+	flag.IntVar(&policy.breakerThreshold, "breaker-threshold", policy.breakerThreshold, "consecutive failures after which a source is skipped")
+	flag.DurationVar(&policy.breakerCooldown, "breaker-cooldown", policy.breakerCooldown, "how long a tripped source is skipped before it is tried again")
+	flag.Var(sourceWeights, "weights", "bandwidth share of /stream sources within a priority, as name=n,...")
+	flag.Var(&sourcePriority, "priority", "/stream sources from most to least urgent, as name,...")
+	flag.Var(batchPolicies, "batch", "how /stream coalesces a source's items into parts, as name=items:2;bytes:4096;linger:1s (repeatable)")
+	flag.Func("stream-buffer", fmt.Sprintf("parts buffered per /stream source while the client is slow (default %d)", streamBuffer.size), streamBuffer.setSize)
+	flag.Var(&streamBuffer.overflow, "overflow", "what to do when a /stream buffer is full: block, drop-oldest or disconnect")
+	flag.DurationVar(&writeTimeout, "write-timeout", writeTimeout, "how long writing a single part may take before the client is dropped")
+	flag.Func("cursor-key", "secret that signs /stream page cursors (random by default)", func(value string) error {
+		cursorKey = []byte(value)
+		return nil
+	})
+	flag.Var(cacheTTLs, "cache", "cache /stream sources for a while, as name=ttl,...")
+	flag.Var(routeInterceptors, "intercept", "interceptors the parts of a route go through, in order, as /route=name,... where name is metrics, redact, sign or envelope (repeatable)")
+	flag.Var(&redactFields, "redact", "JSON fields the redact interceptor hides, as name,...")
+	flag.Func("sign-key", "secret the sign interceptor signs parts with", func(value string) error {
+		signKey = []byte(value)
+		return nil
+	})
+	flag.Parse()
+	if err := routeInterceptors.validate(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(2)
+	}
+	if err := policy.validate(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(2)
+	}
+
+	jobs := newJobManager(*jobWorkers, *jobTTL)
+
 	http.HandleFunc("/stream", streamHandler)
+	http.HandleFunc("/table-data", streamTableData)
+	http.HandleFunc("GET /search", searchHandler)
+	http.HandleFunc("POST /jobs", jobs.createJob)
+	http.HandleFunc("GET /jobs/{id}/stream", jobs.streamJob)
+	http.HandleFunc("DELETE /jobs/{id}", jobs.cancelJob)
+	http.HandleFunc("POST /batch", batchHandler(http.DefaultServeMux))
+	http.HandleFunc("POST /ingest", ingestHandler)
+	http.HandleFunc("POST /admin/cache/invalidate", invalidateCacheHandler)
+	http.HandleFunc("GET /posts/{id}/stream", entityStreamHandler("post"))
+	http.HandleFunc("GET /users/{id}/stream", entityStreamHandler("user"))
+	http.HandleFunc("PUT /posts/{id}", putHandler("post"))
+	http.HandleFunc("PUT /comments/{id}", putHandler("comment"))
+	http.HandleFunc("PUT /users/{id}", putHandler("user"))
+	http.HandleFunc("DELETE /posts/{id}", deleteHandler("post"))
+	http.HandleFunc("DELETE /comments/{id}", deleteHandler("comment"))
+	http.HandleFunc("DELETE /users/{id}", deleteHandler("user"))
 	// send index.html
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "public/index.html")
 	})
 	fmt.Println("Listening at http://localhost:8080")
 
-
-	http.ListenAndServe(":8080", nil)
+	// Allow HTTP/2 without TLS so /ingest can be full duplex end to end.
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	server := &http.Server{Addr: ":8080", Protocols: &protocols}
+	server.ListenAndServe()
 }
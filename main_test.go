@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/M0rfes/multipart-mixed/client"
+)
+
+// snapshotEntities returns the entities of snap as a client decodes them.
+func snapshotEntities(t *testing.T, snap *snapshot) client.Entities {
+	t.Helper()
+	want := make(client.Entities)
+	put := func(typ, id string, entity any) {
+		data, err := json.Marshal(entity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v any
+		json.Unmarshal(data, &v)
+		want[typ+"/"+id] = v
+	}
+	for _, p := range snap.Posts() {
+		put("post", p.ID, p)
+	}
+	for _, c := range snap.Comments() {
+		put("comment", c.ID, c)
+	}
+	for _, u := range snap.Users() {
+		put("user", u.ID, u)
+	}
+	return want
+}
+
+// A client that reads a stream and then the changes since it ends up with the
+// store's entities.
+func TestClientReadStream(t *testing.T) {
+	savedDB, savedLatency := db, emitLatency
+	db, emitLatency = newStore(posts, comments, users), time.Millisecond
+	defer func() { db, emitLatency = savedDB, savedLatency }()
+	srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer srv.Close()
+
+	entities := make(client.Entities)
+	read := func(target string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := entities.ReadStream(resp); err != nil {
+			t.Fatal(err)
+		}
+		if want := snapshotEntities(t, db.snapshot()); !reflect.DeepEqual(entities, want) {
+			t.Errorf("%s: entities = %v, want %v", target, entities, want)
+		}
+	}
+	read("/stream")
+
+	from := db.snapshot()
+	p := from.Posts()[0]
+	p.Data = "changed"
+	if _, err := db.PutPosts(p); err != nil {
+		t.Fatal(err)
+	}
+	u := from.Users()[0]
+	if err := db.Delete("user", u.ID, u.Version); err != nil {
+		t.Fatal(err)
+	}
+	read("/stream?since=" + strconv.FormatUint(from.version, 10))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const boundary = "boundary123abc"
+
+// partWriter writes multipart/mixed parts to a streaming response. It is safe
+// for concurrent use.
+type partWriter struct {
+	mu       sync.Mutex
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	flusher  http.Flusher
+	boundary string
+	chain    *interceptorChain // nil if the route has no interceptors
+	err      error             // first write error; later parts are dropped
+}
+
+// newPartWriter sends the multipart/mixed response headers. It reports false
+// if the response cannot be streamed, in which case an error has already been
+// written.
+func newPartWriter(w http.ResponseWriter, r *http.Request) (*partWriter, bool) {
+	return newPartWriterBoundary(w, r, boundary)
+}
+
+// newPartWriterBoundary is like newPartWriter but with a custom boundary, for
+// responses whose parts may themselves contain the default one. Parts go
+// through the interceptors of r's route.
+func newPartWriterBoundary(w http.ResponseWriter, r *http.Request, boundary string) (*partWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return nil, false
+	}
+	w.Header().Set("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%s", boundary))
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.WriteHeader(200)
+	pw := &partWriter{w: w, rc: http.NewResponseController(w), flusher: flusher, boundary: boundary}
+	pw.chain = newInterceptorChain(r, pw.writeUnframed)
+	return pw, true
+}
+
+func (pw *partWriter) sendPart(jsonPayload string) {
+	pw.writePart(http.Header{"Content-Type": {"application/json"}}, []byte(jsonPayload))
+}
+
+// sendJSON encodes v straight into the part.
+func (pw *partWriter) sendJSON(v any) {
+	b, err := encodeJSONPart(pw.boundary, nil, func(b *partBuffer) error { return b.encode(v) })
+	if err != nil {
+		fmt.Println("Error marshalling part:", err)
+		return
+	}
+	pw.writeFrame(b)
+}
+
+// writePart writes a part with arbitrary headers.
+func (pw *partWriter) writePart(header http.Header, body []byte) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.chain != nil {
+		pw.chain.send(part{Header: header, Body: body})
+		return
+	}
+	pw.writeUnframed(part{Header: header, Body: body})
+}
+
+// writeFrame writes an encoded part with a single write and releases its
+// buffer.
+func (pw *partWriter) writeFrame(b *partBuffer) {
+	defer b.release()
+	pw.writeEncoded(b.Bytes(), b.spans)
+}
+
+// writeEncoded writes encoded parts. On a route with interceptors, the parts
+// spans locates go through them instead.
+func (pw *partWriter) writeEncoded(data []byte, spans []partSpan) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.chain == nil || len(spans) == 0 {
+		pw.write(data)
+		return
+	}
+	for _, s := range spans {
+		pw.chain.send(s.part(data))
+	}
+}
+
+// writeUnframed frames p and writes it. pw.mu must be held.
+func (pw *partWriter) writeUnframed(p part) {
+	b, err := encodePart(pw.boundary, p.Header, "", func(b *partBuffer) error {
+		_, err := b.Write(p.Body)
+		return err
+	})
+	if err != nil {
+		fmt.Println("Error framing part:", err)
+		return
+	}
+	defer b.release()
+	pw.write(b.Bytes())
+}
+
+// write writes encoded parts. Each write must finish within writeTimeout; if
+// it does not, or fails, pw.err is set and the rest of the stream is
+// discarded. pw.mu must be held.
+func (pw *partWriter) write(frame []byte) {
+	if pw.err != nil {
+		return
+	}
+	if writeTimeout > 0 {
+		pw.rc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	_, err := pw.w.Write(frame)
+	if err == nil {
+		err = pw.rc.Flush()
+	}
+	if err != nil {
+		pw.err = err
+	}
+}
+
+// close writes the closing boundary.
+func (pw *partWriter) close() {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.chain != nil {
+		pw.chain.end()
+	}
+	fmt.Fprintf(pw.w, "--%s--\r\n", pw.boundary)
+	pw.flusher.Flush()
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const maxPageLimit = 1000
+
+// cursorKey signs page cursors. It is random unless -cursor-key sets it, so
+// by default cursors do not survive a restart.
+var cursorKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// pageCursor is the position of a page in the posts, which are kept in the
+// order they were created. Pages are keyed by the last post before them, so
+// posts created later never shift them.
+type pageCursor struct {
+	After string `json:"after"` // id of the last post of the previous page
+	Limit int    `json:"limit"`
+}
+
+// encode signs c, so a client cannot forge a position it was not given.
+func (c pageCursor) encode() string {
+	payload, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signCursor(payload))
+}
+
+func decodeCursor(value string) (pageCursor, error) {
+	var c pageCursor
+	invalid := errors.New("invalid cursor")
+	payloadPart, sigPart, ok := strings.Cut(value, ".")
+	if !ok {
+		return c, invalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(payloadPart)
+	if err != nil {
+		return c, invalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigPart)
+	if err != nil || !hmac.Equal(sig, signCursor(payload)) {
+		return c, invalid
+	}
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return c, invalid
+	}
+	return c, nil
+}
+
+func signCursor(payload []byte) []byte {
+	mac := hmac.New(sha256.New, cursorKey)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// parsePage reads ?limit and ?cursor. ok is false if the request is not
+// paged. A limit given with a cursor overrides the cursor's.
+func parsePage(r *http.Request) (c pageCursor, ok bool, err error) {
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		if c, err = decodeCursor(value); err != nil {
+			return c, false, err
+		}
+		ok = true
+	}
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return c, false, fmt.Errorf("invalid limit %q, want 1 to %d", value, maxPageLimit)
+		}
+		c.Limit, ok = limit, true
+	}
+	if ok && c.Limit == 0 {
+		return c, false, errors.New("limit is required without a cursor")
+	}
+	return c, ok, nil
+}
+
+// page returns the ids of the posts on the page at c and the part that ends
+// it, with the cursor of the next page if there is one.
+func (sn *snapshot) page(c pageCursor) ([]string, map[string]any, error) {
+	start := 0
+	if c.After != "" {
+		i := slices.IndexFunc(sn.posts, func(p Post) bool { return p.ID == c.After })
+		if i < 0 {
+			return nil, nil, errors.New("invalid cursor")
+		}
+		start = i + 1
+	}
+	ids := []string{}
+	next := ""
+	for _, p := range sn.posts[start:] {
+		if _, ok := sn.get("post", p.ID); !ok {
+			continue
+		}
+		if len(ids) == c.Limit {
+			next = pageCursor{After: ids[len(ids)-1], Limit: c.Limit}.encode()
+			break
+		}
+		ids = append(ids, p.ID)
+	}
+	trailer := map[string]any{"type": "page", "count": len(ids), "next": nil}
+	if next != "" {
+		trailer["next"] = next
+	}
+	return ids, trailer, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// patchFormat is how live streams send updates to an entity.
+type patchFormat string
+
+const (
+	jsonPatch  patchFormat = "json-patch"  // RFC 6902
+	mergePatch patchFormat = "merge-patch" // RFC 7396
+)
+
+func parsePatchFormat(value string) (patchFormat, error) {
+	switch f := patchFormat(value); f {
+	case "", jsonPatch:
+		return jsonPatch, nil
+	case mergePatch:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid patch %q, want json-patch or merge-patch", value)
+}
+
+func (f patchFormat) contentType() string {
+	if f == mergePatch {
+		return "application/merge-patch+json"
+	}
+	return "application/json-patch+json"
+}
+
+// patchOp is one RFC 6902 operation. Value is kept encoded so that a null
+// value is still sent.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// diff returns the patch that turns old into new in format f, or nil if they
+// encode the same.
+func (f patchFormat) diff(old, new any) (any, error) {
+	a, err := toJSONValue(old)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toJSONValue(new)
+	if err != nil {
+		return nil, err
+	}
+	if reflect.DeepEqual(a, b) {
+		return nil, nil
+	}
+	if f == mergePatch {
+		return mergeDiff(a, b), nil
+	}
+	return jsonDiff(nil, "", a, b)
+}
+
+// toJSONValue round-trips v through JSON, so it can be compared field by
+// field the way clients see it.
+func toJSONValue(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	err = json.Unmarshal(data, &out)
+	return out, err
+}
+
+// jsonDiff appends the operations that turn a into b at path. Objects are
+// compared member by member; anything else, arrays included, is replaced
+// whole.
+func jsonDiff(ops []patchOp, path string, a, b any) ([]patchOp, error) {
+	ao, aok := a.(map[string]any)
+	bo, bok := b.(map[string]any)
+	if !aok || !bok {
+		if reflect.DeepEqual(a, b) {
+			return ops, nil
+		}
+		value, err := json.Marshal(b)
+		return append(ops, patchOp{Op: "replace", Path: path, Value: value}), err
+	}
+	for _, k := range slices.Sorted(maps.Keys(ao)) {
+		if _, ok := bo[k]; !ok {
+			ops = append(ops, patchOp{Op: "remove", Path: path + "/" + escapePointer(k)})
+		}
+	}
+	var err error
+	for _, k := range slices.Sorted(maps.Keys(bo)) {
+		av, ok := ao[k]
+		if !ok {
+			value, err := json.Marshal(bo[k])
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, patchOp{Op: "add", Path: path + "/" + escapePointer(k), Value: value})
+			continue
+		}
+		if ops, err = jsonDiff(ops, path+"/"+escapePointer(k), av, bo[k]); err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+// mergeDiff returns the merge patch that turns a into b. Removed members are
+// set to null.
+func mergeDiff(a, b any) any {
+	ao, aok := a.(map[string]any)
+	bo, bok := b.(map[string]any)
+	if !aok || !bok {
+		return b
+	}
+	patch := make(map[string]any)
+	for k := range ao {
+		if _, ok := bo[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	for k, bv := range bo {
+		if av, ok := ao[k]; !ok || !reflect.DeepEqual(av, bv) {
+			patch[k] = mergeDiff(av, bv)
+		}
+	}
+	return patch
+}
+
+// escapePointer escapes a member name for a JSON Pointer (RFC 6901).
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
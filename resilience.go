@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// sourcePolicy controls how /stream runs its sources.
+type sourcePolicy struct {
+	timeout          time.Duration
+	retries          int
+	backoff          time.Duration // first retry delay, doubled on each attempt
+	maxBackoff       time.Duration
+	breakerThreshold int
+	breakerCooldown  time.Duration
+}
+
+var policy = sourcePolicy{
+	timeout:          30 * time.Second,
+	retries:          2,
+	backoff:          200 * time.Millisecond,
+	maxBackoff:       5 * time.Second,
+	breakerThreshold: 3,
+	breakerCooldown:  30 * time.Second,
+}
+
+// breaker tracks consecutive failures of a source across requests. Once
+// threshold is reached the source is skipped until the cooldown has passed,
+// after which one request is let through to try it again.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*breaker)
+)
+
+func breakerFor(name string) *breaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[name]
+	if !ok {
+		b = &breaker{}
+		breakers[name] = b
+	}
+	return b
+}
+
+// allow reports whether the source may run now.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < policy.breakerThreshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// release ends a probe that was cut short without an outcome, so that the
+// next request can probe again.
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= policy.breakerThreshold {
+		b.openUntil = time.Now().Add(policy.breakerCooldown)
+	}
+}
+
+// validate checks the policy once the flags are parsed.
+func (p sourcePolicy) validate() error {
+	if p.retries < 0 {
+		return fmt.Errorf("invalid source retries %d, want 0 or more", p.retries)
+	}
+	return nil
+}
+
+// backoffDelay returns the delay before retry attempt n (1-based), using
+// exponential backoff with full jitter.
+func backoffDelay(n int) time.Duration {
+	// Doubling stops at maxBackoff, so many retries cannot overflow it.
+	d := policy.backoff
+	for i := 1; i < n && d < policy.maxBackoff; i++ {
+		d *= 2
+	}
+	return rand.N(min(d, policy.maxBackoff)) + 1
+}
+
+// runSource runs src from offset under the per-source deadline, retrying
+// failed attempts from where the previous one stopped, and reports each outcome
+// as a status part on ch. It returns the offset reached and whether the source
+// finished.
+func runSource(ctx context.Context, src Source[any], offset int, ch chan<- Item[any]) (int, bool) {
+	b := breakerFor(src.Name)
+	if !b.allow() {
+		sendStatus(ctx, ch, src.Name, "circuit-open", offset, nil)
+		return offset, false
+	}
+
+	reqCtx := ctx
+	ctx, cancel := context.WithTimeout(ctx, policy.timeout)
+	defer cancel()
+
+	sent := offset
+	var err error
+	for attempt := 0; ; attempt++ {
+		var n int
+		n, err = runAttempt(ctx, src, sent, ch)
+		sent += n
+		if err == nil || ctx.Err() != nil || attempt == policy.retries {
+			break
+		}
+		delay := backoffDelay(attempt + 1)
+		sendStatus(ctx, ch, src.Name, "retrying", sent, map[string]any{
+			"attempt": attempt + 1,
+			"error":   err.Error(),
+			"delayMs": delay.Milliseconds(),
+		})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+
+	switch {
+	case reqCtx.Err() != nil:
+		// The client went away or the stream ran out of budget; that says
+		// nothing about the source.
+		b.release()
+		return sent, false
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		b.record(ctx.Err())
+		sendStatus(reqCtx, ch, src.Name, "timeout", sent, nil)
+	case err != nil:
+		b.record(err)
+		sendStatus(ctx, ch, src.Name, "failed", sent, map[string]any{"error": err.Error()})
+	default:
+		b.record(nil)
+		sendStatus(ctx, ch, src.Name, "complete", sent, nil)
+	}
+	return sent, err == nil && ctx.Err() == nil
+}
+
+// runAttempt runs src once starting at offset and returns how many parts it
+// forwarded to ch.
+func runAttempt(ctx context.Context, src Source[any], offset int, ch chan<- Item[any]) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	attemptCh := make(chan Item[any])
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- src.Run(ctx, offset, attemptCh)
+		close(attemptCh)
+	}()
+
+	sent := 0
+	for it := range attemptCh {
+		select {
+		case ch <- it:
+			sent++
+		case <-ctx.Done():
+			cancel()
+		}
+	}
+	return sent, <-errCh
+}
+
+func sendStatus(ctx context.Context, ch chan<- Item[any], name, status string, delivered int, extra map[string]any) {
+	value := map[string]any{"type": "status", "source": name, "status": status, "delivered": delivered}
+	for k, v := range extra {
+		value[k] = v
+	}
+	select {
+	case ch <- Item[any]{Type: "status", Value: value}:
+	case <-ctx.Done():
+	}
+}
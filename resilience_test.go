@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// A half-open probe whose request ends before the source does must not leave
+// the breaker refusing every later request.
+func TestBreakerProbeCutShort(t *testing.T) {
+	const name = "test-probe-cut-short"
+	b := breakerFor(name)
+	b.failures = policy.breakerThreshold // open, with the cooldown over
+
+	started := make(chan struct{})
+	src := Source[any]{Name: name, Run: func(ctx context.Context, offset int, ch chan<- Item[any]) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runSource(ctx, src, 0, make(chan Item[any]))
+	}()
+	<-started
+	if b.allow() {
+		t.Fatal("a second probe was let through while the first ran")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("runSource did not return after the request ended")
+	}
+	if !b.allow() {
+		t.Fatal("breaker still refuses requests after the probe was cut short")
+	}
+}
+
+// Delays stop growing at maxBackoff, however many retries there are.
+func TestBackoffDelay(t *testing.T) {
+	for n := 1; n <= 100; n++ {
+		if d := backoffDelay(n); d < 1 || d > policy.maxBackoff {
+			t.Errorf("backoffDelay(%d) = %s, want 1ns to %s", n, d, policy.maxBackoff)
+		}
+	}
+}
+
+func TestSourcePolicyValidate(t *testing.T) {
+	p := policy
+	p.retries = -1
+	if err := p.validate(); err == nil {
+		t.Error("negative retries were accepted")
+	}
+	p.retries = 40
+	if err := p.validate(); err != nil {
+		t.Error(err)
+	}
+}
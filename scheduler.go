@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const schedQuantum = 1024 // bytes a weight of 1 earns per round
+
+// sourceWeights are the bandwidth shares of the sources within a priority, set
+// with -weights. Sources without a weight get 1.
+var sourceWeights = weightFlags{}
+
+// sourcePriority lists sources from most to least urgent, set with -priority
+// and overridden per request with ?priority=. Unlisted sources share the
+// lowest priority.
+var sourcePriority listFlag
+
+type weightFlags map[string]int
+
+func (f weightFlags) String() string {
+	pairs := make([]string, 0, len(f))
+	for name, weight := range f {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", name, weight))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set parses name=weight pairs separated by commas.
+func (f weightFlags) Set(value string) error {
+	for _, pair := range strings.Split(value, ",") {
+		name, w, ok := strings.Cut(pair, "=")
+		weight, err := strconv.Atoi(w)
+		if !ok || err != nil || weight < 1 {
+			return fmt.Errorf("invalid weight %q, want name=n with n >= 1", pair)
+		}
+		f[name] = weight
+	}
+	return nil
+}
+
+// listFlag is a comma separated list.
+type listFlag []string
+
+func (f *listFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *listFlag) Set(value string) error {
+	*f = strings.Split(value, ",")
+	return nil
+}
+
+type schedQueue[T any] struct {
+	name     string
+	priority int // lower is more urgent
+	weight   int
+	items    []Item[T]
+	deficit  int
+	credited bool // whether the queue got its quantum on the current visit
+	done     bool
+}
+
+// scheduler orders the items of several sources. Each source has a small
+// bounded queue. next serves the most urgent priority that has items waiting
+// and, within it, shares bandwidth between sources in proportion to their
+// weights using deficit round robin over item sizes. The order only depends
+// on which items are queued, so it is deterministic for a given arrival order.
+type scheduler[T any] struct {
+	buffer  bufferPolicy
+	size    func(Item[T]) int
+	discard func(Item[T]) // called for items dropped on overflow
+	mu      sync.Mutex
+	queues  []*schedQueue[T]
+	byName  map[string]*schedQueue[T]
+	cur     int
+	changed chan struct{} // closed and replaced whenever a queue changes
+}
+
+// newScheduler creates a queue for each source. priority lists sources from most
+// to least urgent.
+func newScheduler[T any](names []string, priority []string, weights map[string]int, buffer bufferPolicy, size func(Item[T]) int, discard func(Item[T])) *scheduler[T] {
+	s := &scheduler[T]{buffer: buffer, size: size, discard: discard, byName: make(map[string]*schedQueue[T]), changed: make(chan struct{})}
+	for _, name := range names {
+		q := &schedQueue[T]{name: name, priority: len(priority), weight: max(weights[name], 1)}
+		for i, p := range priority {
+			if p == name {
+				q.priority = i
+			}
+		}
+		s.queues = append(s.queues, q)
+		s.byName[name] = q
+	}
+	return s
+}
+
+func (s *scheduler[T]) signal() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// push queues an item of the named source. When the queue is full it waits,
+// drops the oldest queued item or fails with errSlowClient, depending on the
+// overflow policy.
+func (s *scheduler[T]) push(ctx context.Context, name string, it Item[T]) error {
+	for {
+		s.mu.Lock()
+		q := s.byName[name]
+		if len(q.items) >= s.buffer.size {
+			switch s.buffer.overflow {
+			case overflowDropOldest:
+				s.discard(q.items[0])
+				q.items = q.items[1:]
+				droppedParts.Add(1)
+			case overflowDisconnect:
+				s.mu.Unlock()
+				s.discard(it)
+				return errSlowClient
+			}
+		}
+		if len(q.items) < s.buffer.size {
+			q.items = append(q.items, it)
+			s.signal()
+			s.mu.Unlock()
+			return nil
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			s.discard(it)
+			return ctx.Err()
+		}
+	}
+}
+
+// finish marks the named source as done; next still drains its queue.
+func (s *scheduler[T]) finish(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byName[name].done = true
+	s.signal()
+}
+
+// next returns the next item to send. It reports false once every source is
+// finished and drained, or when ctx is done.
+func (s *scheduler[T]) next(ctx context.Context) (Item[T], bool) {
+	for {
+		s.mu.Lock()
+		if it, ok := s.pop(); ok {
+			s.signal()
+			s.mu.Unlock()
+			return it, true
+		}
+		finished := true
+		for _, q := range s.queues {
+			finished = finished && q.done
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		if finished {
+			return Item[T]{}, false
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return Item[T]{}, false
+		}
+	}
+}
+
+// pop runs deficit round robin over the non-empty queues of the most urgent
+// priority. s.mu must be held.
+func (s *scheduler[T]) pop() (Item[T], bool) {
+	top := -1
+	for _, q := range s.queues {
+		if len(q.items) > 0 && (top == -1 || q.priority < top) {
+			top = q.priority
+		}
+	}
+	if top == -1 {
+		return Item[T]{}, false
+	}
+	for {
+		q := s.queues[s.cur]
+		if q.priority == top && len(q.items) > 0 {
+			if !q.credited {
+				q.deficit += q.weight * schedQuantum
+				q.credited = true
+			}
+			if size := s.size(q.items[0]); size <= q.deficit {
+				it := q.items[0]
+				q.items = q.items[1:]
+				q.deficit -= size
+				return it, true
+			}
+		}
+		if len(q.items) == 0 {
+			q.deficit = 0
+		}
+		q.credited = false
+		s.cur = (s.cur + 1) % len(s.queues)
+	}
+}
+
+// parsePriority reads ?priority=post,comment,user, falling back to the
+// server-wide -priority. Every name must be one of the stream's sources.
+func parsePriority(value string, sources []Source[any]) ([]string, error) {
+	if value == "" {
+		return sourcePriority, nil
+	}
+	priority := strings.Split(value, ",")
+	for _, name := range priority {
+		known := false
+		for _, src := range sources {
+			known = known || src.Name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown source %q in priority", name)
+		}
+	}
+	return priority, nil
+}
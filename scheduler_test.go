@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testScheduler returns a scheduler whose items are as large as their value.
+func testScheduler(names, priority []string, weights map[string]int) *scheduler[int] {
+	return newScheduler(names, priority, weights, bufferPolicy{size: 64, overflow: overflowBlock},
+		func(it Item[int]) int { return it.Value }, func(Item[int]) {})
+}
+
+// queue pushes n items of size bytes for each source.
+func queue(t *testing.T, s *scheduler[int], n, size int, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		for range n {
+			if err := s.push(t.Context(), name, Item[int]{Type: name, Value: size}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// sendOrder returns the sources of the next n items, in order.
+func sendOrder(t *testing.T, s *scheduler[int], n int) []string {
+	t.Helper()
+	order := make([]string, 0, n)
+	for range n {
+		it, ok := s.next(t.Context())
+		if !ok {
+			t.Fatalf("scheduler ended after %d items", len(order))
+		}
+		order = append(order, it.Type)
+	}
+	return order
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := testScheduler([]string{"post", "comment", "user"}, []string{"user", "post"}, nil)
+	queue(t, s, 2, 100, "post", "comment", "user")
+	want := []string{"user", "user", "post", "post", "comment"}
+	if got := sendOrder(t, s, 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %q, want %q", got, want)
+	}
+	// A more urgent item goes ahead of the ones already waiting.
+	queue(t, s, 1, 100, "comment", "user")
+	if got, want := sendOrder(t, s, 3), []string{"user", "comment", "comment"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %q, want %q", got, want)
+	}
+}
+
+func TestSchedulerWeights(t *testing.T) {
+	s := testScheduler([]string{"post", "comment"}, nil, map[string]int{"post": 3})
+	queue(t, s, 12, schedQuantum, "post", "comment")
+	got := strings.Join(sendOrder(t, s, 16), " ")
+	want := strings.Repeat("post post post comment ", 4)
+	if got != strings.TrimSpace(want) {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+}
+
+// The share is of bytes, not items: a source with parts half the size sends
+// twice as many.
+func TestSchedulerBandwidthShare(t *testing.T) {
+	s := testScheduler([]string{"post", "comment"}, nil, nil)
+	queue(t, s, 40, schedQuantum/4, "post")
+	queue(t, s, 20, schedQuantum/2, "comment")
+	sent := map[string]int{}
+	for range 30 {
+		it, _ := s.next(t.Context())
+		sent[it.Type] += it.Value
+	}
+	if sent["post"] != sent["comment"] {
+		t.Errorf("bytes sent = %v, want an equal share", sent)
+	}
+}
+
+// An item larger than the quantum waits until its source has built up enough
+// deficit, while the others keep their share.
+func TestSchedulerLargeItem(t *testing.T) {
+	s := testScheduler([]string{"post", "comment"}, nil, nil)
+	queue(t, s, 1, 3*schedQuantum, "post")
+	queue(t, s, 4, schedQuantum, "comment")
+	if got, want := sendOrder(t, s, 5), []string{"comment", "comment", "post", "comment", "comment"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("order = %q, want %q", got, want)
+	}
+}
+
+// The same items queued in the same order are always sent in the same order.
+func TestSchedulerDeterministic(t *testing.T) {
+	run := func() []string {
+		s := testScheduler([]string{"post", "comment", "user"}, []string{"post"}, map[string]int{"comment": 2})
+		for i := range 10 {
+			queue(t, s, 1, 300+100*i, "post", "comment", "user")
+		}
+		return sendOrder(t, s, 30)
+	}
+	first := run()
+	for range 5 {
+		if got := run(); !reflect.DeepEqual(got, first) {
+			t.Fatalf("order = %q, then %q", first, got)
+		}
+	}
+}
+
+func TestSchedulerFinish(t *testing.T) {
+	s := testScheduler([]string{"post", "comment"}, nil, nil)
+	queue(t, s, 2, 100, "post")
+	s.finish("post")
+	s.finish("comment")
+	if got := sendOrder(t, s, 2); len(got) != 2 {
+		t.Fatalf("drained %q", got)
+	}
+	if _, ok := s.next(t.Context()); ok {
+		t.Error("next returned an item after every source finished")
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	s := testScheduler([]string{"post"}, nil, nil)
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, ok := s.next(ctx); ok {
+		t.Error("next returned an item after ctx was done")
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	sources := []Source[any]{{Name: "post"}, {Name: "comment"}, {Name: "user"}}
+	got, err := parsePriority("user,post", sources)
+	if err != nil || !reflect.DeepEqual(got, []string{"user", "post"}) {
+		t.Errorf("parsePriority = %q, %v", got, err)
+	}
+	if _, err := parsePriority("post,tag", sources); err == nil {
+		t.Error("an unknown source was accepted")
+	}
+}
+
+func TestWeightFlags(t *testing.T) {
+	f := weightFlags{}
+	if err := f.Set("post=3,comment=1"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (weightFlags{"post": 3, "comment": 1}); !reflect.DeepEqual(f, want) {
+		t.Errorf("weights = %v, want %v", f, want)
+	}
+	for _, value := range []string{"post", "post=0", "post=x", "post=2,user"} {
+		if err := (weightFlags{}).Set(value); err == nil {
+			t.Errorf("Set(%q) succeeded", value)
+		}
+	}
+}
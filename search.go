@@ -0,0 +1,191 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// searchIndex is an inverted index of the words in post data and comment
+// text. A store watcher keeps it up to date, so it is guarded by db.mu.
+type searchIndex struct {
+	postings map[string]map[string]int // word -> entity key -> occurrences
+	words    []string                  // the words in postings, sorted for prefix lookups
+	docs     map[string][]string       // entity key -> its words
+}
+
+type searchHit struct {
+	Key   string
+	Score float64
+}
+
+var index = &searchIndex{postings: make(map[string]map[string]int), docs: make(map[string][]string)}
+
+// The index is built before main runs, so no write can race with it.
+func init() {
+	snap := db.onWrite(index.apply)
+	for _, p := range snap.Posts() {
+		index.add(entityKey("post", p.ID), p.Data)
+	}
+	for _, c := range snap.Comments() {
+		index.add(entityKey("comment", c.ID), c.Text)
+	}
+}
+
+// tokenize splits text into lower-cased words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func (ix *searchIndex) apply(c change) {
+	key := entityKey(c.Entity, c.ID)
+	ix.remove(key)
+	switch v := c.New.(type) {
+	case Post:
+		ix.add(key, v.Data)
+	case Comment:
+		ix.add(key, v.Text)
+	}
+}
+
+func (ix *searchIndex) add(key, text string) {
+	words := tokenize(text)
+	ix.docs[key] = words
+	for _, w := range words {
+		if ix.postings[w] == nil {
+			ix.postings[w] = make(map[string]int)
+			i, _ := slices.BinarySearch(ix.words, w)
+			ix.words = slices.Insert(ix.words, i, w)
+		}
+		ix.postings[w][key]++
+	}
+}
+
+func (ix *searchIndex) remove(key string) {
+	for _, w := range ix.docs[key] {
+		delete(ix.postings[w], key)
+		if len(ix.postings[w]) == 0 {
+			delete(ix.postings, w)
+			if i, ok := slices.BinarySearch(ix.words, w); ok {
+				ix.words = slices.Delete(ix.words, i, i+1)
+			}
+		}
+	}
+	delete(ix.docs, key)
+}
+
+// search returns the entities that have, for every word of the query, a word
+// starting with it, best first. Rare words count more than common ones, and
+// whole words more than prefixes.
+func (ix *searchIndex) search(query string) []searchHit {
+	terms := slices.Compact(slices.Sorted(slices.Values(tokenize(query))))
+	if len(terms) == 0 {
+		return nil
+	}
+	scores := make(map[string]float64)
+	matched := make(map[string]int)
+	for _, t := range terms {
+		seen := make(map[string]bool)
+		i, _ := slices.BinarySearch(ix.words, t)
+		for ; i < len(ix.words) && strings.HasPrefix(ix.words[i], t); i++ {
+			w := ix.words[i]
+			idf := math.Log(1 + float64(len(ix.docs))/float64(len(ix.postings[w])))
+			weight := 1.0
+			if w == t {
+				weight = 2
+			}
+			for key, n := range ix.postings[w] {
+				scores[key] += float64(n) * idf * weight
+				seen[key] = true
+			}
+		}
+		for key := range seen {
+			matched[key]++
+		}
+	}
+	var hits []searchHit
+	for key, n := range matched {
+		if n == len(terms) {
+			hits = append(hits, searchHit{Key: key, Score: scores[key]})
+		}
+	}
+	slices.SortFunc(hits, func(a, b searchHit) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(a.Key, b.Key))
+	})
+	return hits
+}
+
+// searchHandler serves GET /search?q=. Matching posts and comments are
+// streamed best first, with their score in X-Search-Score, followed by the
+// comments of the matching posts and then the users of all those comments.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	if len(tokenize(query)) == 0 {
+		http.Error(w, "q must contain a word", http.StatusBadRequest)
+		return
+	}
+	var items []Item[any]
+	db.read(func(snap *snapshot) {
+		items = searchResults(snap, index.search(query))
+	})
+	// The results are already in memory, so they are sent as is, without the
+	// latency, retries and status parts of a source.
+	frames := make(chan Item[*partBuffer])
+	go func() {
+		defer close(frames)
+		for _, it := range items {
+			b, err := encodeBatch(boundary, []Item[any]{it})
+			if err != nil {
+				fmt.Printf("Error marshalling %s part: %v\n", it.Type, err)
+				continue
+			}
+			if !forward(r.Context(), frames, Item[*partBuffer]{Type: it.Type, Value: b}) {
+				b.release()
+				return
+			}
+		}
+	}()
+	writeStream(w, r, frames)
+}
+
+// searchResults returns the items a search streams, in order.
+func searchResults(snap *snapshot, hits []searchHit) []Item[any] {
+	var items []Item[any]
+	sent := make(map[string]bool)
+	add := func(entity, id string, header http.Header) {
+		key := entityKey(entity, id)
+		if sent[key] {
+			return
+		}
+		if v, ok := snap.get(entity, id); ok {
+			items = append(items, Item[any]{Type: entity, ID: id, Header: header, Value: v})
+			sent[key] = true
+		}
+	}
+	for _, hit := range hits {
+		entity, id, _ := strings.Cut(hit.Key, "/")
+		add(entity, id, http.Header{"X-Search-Score": {strconv.FormatFloat(hit.Score, 'f', 3, 64)}})
+	}
+	for _, hit := range hits {
+		if entity, id, _ := strings.Cut(hit.Key, "/"); entity == "post" {
+			if p, ok := snap.get(entity, id); ok {
+				for _, cid := range p.(Post).Comments {
+					add("comment", cid, nil)
+				}
+			}
+		}
+	}
+	for _, it := range slices.Clone(items) {
+		if c, ok := it.Value.(Comment); ok {
+			add("user", c.User, nil)
+		}
+	}
+	return items
+}
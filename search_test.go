@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Search results are computed up front, so they are streamed at once, best
+// first, with no source status parts.
+func TestSearchStream(t *testing.T) {
+	r := httptest.NewRequest("GET", "/search?q=hello", nil)
+	r.Pattern = "GET /search"
+	w := httptest.NewRecorder()
+	start := time.Now()
+	searchHandler(w, r)
+	if elapsed := time.Since(start); elapsed > emitLatency {
+		t.Errorf("search took %s", elapsed)
+	}
+	parts := readParts(t, w)
+	if len(parts) == 0 {
+		t.Fatal("no parts")
+	}
+	scored := true
+	for i, p := range parts {
+		if p.Header.Get("X-Search-Score") == "" {
+			scored = false
+		} else if !scored {
+			t.Errorf("part %d has a score after the unscored parts", i)
+		}
+		if got := string(p.Body); !strings.HasPrefix(got, `{"type":"post"`) && !strings.HasPrefix(got, `{"type":"comment"`) && !strings.HasPrefix(got, `{"type":"user"`) {
+			t.Errorf("unexpected part %s", got)
+		}
+	}
+	if parts[0].Header.Get("X-Search-Score") == "" {
+		t.Error("the first part is not a hit")
+	}
+}
+
+func TestSearchNeedsWord(t *testing.T) {
+	w := httptest.NewRecorder()
+	searchHandler(w, httptest.NewRequest("GET", "/search?q=+!", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+)
+
+// streamSources returns the sources for a /stream request: the local producers
+// reading v, with any configured upstream taking the place of the local one of
+// the same name. When v asks for changes since a version, deletions are
+// streamed as tombstones as well.
+func streamSources(r *http.Request, v view) []Source[any] {
+	sources := v.sources("post", "comment", "user")
+	if v.since > 0 {
+		sources = append(sources, Untyped(Source[tombstone]{Name: "tombstone", Run: v.getTombstones}))
+	}
+	for _, u := range upstreams {
+		src := Untyped(u.source(r.Header, forwardHeaders))
+		replaced := false
+		for i := range sources {
+			if sources[i].Name == u.name {
+				sources[i], replaced = src, true
+			}
+		}
+		if !replaced {
+			sources = append(sources, src)
+		}
+	}
+	return sources
+}
+
+// sources returns the producers of the entity types that read v, in order.
+func (v view) sources(entities ...string) []Source[any] {
+	sources := make([]Source[any], len(entities))
+	for i, entity := range entities {
+		switch entity {
+		case "post":
+			sources[i] = Untyped(Source[Post]{Name: entity, Run: v.getPosts})
+		case "comment":
+			sources[i] = Untyped(Source[Comment]{Name: entity, Run: v.getComments})
+		case "user":
+			sources[i] = Untyped(Source[User]{Name: entity, Run: v.getUsers})
+		}
+	}
+	return sources
+}
+
+// localEntities returns the entity types of the sources that read the local
+// store, which are the ones a live stream can follow.
+func localEntities(sources []Source[any]) []string {
+	entities := []string{}
+	for _, src := range sources {
+		if isLocal(src.Name) && src.Name != "tombstone" {
+			entities = append(entities, src.Name)
+		}
+	}
+	return entities
+}
+
+// isLocal reports whether the source of that name reads the local store.
+func isLocal(name string) bool {
+	switch name {
+	case "post", "comment", "user", "tombstone":
+		return !slices.ContainsFunc(upstreams, func(u upstream) bool { return u.name == name })
+	}
+	return false
+}
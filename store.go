@@ -0,0 +1,539 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// store holds the posts, comments and users served by the streams.
+//
+// Every write bumps the store's version and makes a new snapshot of the data;
+// snapshots are never modified, so a reader sees the data as of one version
+// however long it takes. Each snapshot knows the version at which each entity
+// last changed, so readers can ask for what changed since a version they have
+// seen. Deletes are soft: the entity is kept, hidden from reads, with a
+// tombstone recording when it went away. Live streams subscribe to the
+// individual changes instead.
+type store struct {
+	mu       sync.RWMutex
+	cur      *snapshot
+	log      []change // the latest changes, oldest first
+	logFloor uint64   // changes up to this version may be missing from log
+	watchers []func(change)
+	feeds    map[chan change]struct{}
+}
+
+// snapshot is the data as of one version.
+type snapshot struct {
+	version     uint64
+	posts       []Post
+	comments    []Comment
+	users       []User
+	modified    map[string]uint64    // by entity key, see entityKey
+	typeVersion map[string]uint64    // last version that changed each entity type
+	deleted     map[string]tombstone // by entity key
+}
+
+// changeLog is how many changes the store keeps for subscribers that start
+// from an earlier version.
+const changeLog = 1024
+
+// change is one entity write, as delivered to subscribers. Old is nil when the
+// entity was created and New is nil when it was deleted.
+type change struct {
+	Entity  string
+	ID      string
+	Version uint64
+	Old     any
+	New     any
+	Cause   string // for a deletion, see tombstone
+}
+
+// tombstone records the deletion of an entity. It is streamed as is.
+type tombstone struct {
+	Type    string `json:"type"` // always "tombstone"
+	Entity  string `json:"entity"`
+	ID      string `json:"id"`
+	Version uint64 `json:"version"`
+	Cause   string `json:"cause,omitempty"` // entity key of the deletion this one cascaded from
+}
+
+// db is seeded with the mock data at version 1.
+var db = newStore(posts, comments, users)
+
+func newStore(posts []Post, comments []Comment, users []User) *store {
+	sn := &snapshot{
+		posts:       slices.Clone(posts),
+		comments:    slices.Clone(comments),
+		users:       slices.Clone(users),
+		version:     1,
+		modified:    make(map[string]uint64),
+		typeVersion: map[string]uint64{"post": 1, "comment": 1, "user": 1},
+		deleted:     make(map[string]tombstone),
+	}
+	for i := range sn.posts {
+		sn.posts[i].Version = 1
+		sn.modified[entityKey("post", sn.posts[i].ID)] = 1
+	}
+	for i := range sn.comments {
+		sn.comments[i].Version = 1
+		sn.modified[entityKey("comment", sn.comments[i].ID)] = 1
+	}
+	for i := range sn.users {
+		sn.users[i].Version = 1
+		sn.modified[entityKey("user", sn.users[i].ID)] = 1
+	}
+	return &store{cur: sn, logFloor: 1, feeds: make(map[chan change]struct{})}
+}
+
+func entityKey(entity, id string) string {
+	return entity + "/" + id
+}
+
+// snapshot returns the current data.
+func (s *store) snapshot() *snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cur
+}
+
+// read calls f with the current snapshot while no write can happen, so state
+// kept up to date by watchers agrees with it.
+func (s *store) read(f func(*snapshot)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f(s.cur)
+}
+
+// Version returns the last version that changed any of the entity types.
+func (sn *snapshot) Version(entities ...string) uint64 {
+	var v uint64
+	for _, entity := range entities {
+		v = max(v, sn.typeVersion[entity])
+	}
+	return v
+}
+
+// onWrite registers f to be called with every change from now on, and
+// returns the snapshot the first of them applies to. f is called with the
+// store locked, in version order, so it must not use the store.
+func (s *store) onWrite(f func(change)) *snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchers = append(s.watchers, f)
+	return s.cur
+}
+
+// subscribe returns a channel that receives every change after version from,
+// and a function to stop. Starting from the version of a snapshot hands over
+// from the snapshot to its changes without losing or repeating any. Changes
+// are never blocked on a slow subscriber: if its buffer fills up the channel
+// is closed, and it has to catch up with a since read.
+func (s *store) subscribe(from uint64, buffer int) (<-chan change, func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if from < s.logFloor {
+		return nil, nil, fmt.Errorf("changes since version %d are no longer kept", from)
+	}
+	i, _ := slices.BinarySearchFunc(s.log, from+1, func(c change, v uint64) int { return cmp.Compare(c.Version, v) })
+	backlog := s.log[i:]
+	ch := make(chan change, buffer+len(backlog))
+	for _, c := range backlog {
+		ch <- c
+	}
+	s.feeds[ch] = struct{}{}
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.feeds[ch]; ok {
+			delete(s.feeds, ch)
+			close(ch)
+		}
+	}, nil
+}
+
+// commit makes next the current snapshot and delivers its changes to the
+// watchers and subscribers. s.mu must be held, so that every one of them sees
+// the changes in version order.
+func (s *store) commit(next *snapshot, changes ...change) {
+	s.cur = next
+	for _, f := range s.watchers {
+		for _, c := range changes {
+			f(c)
+		}
+	}
+	s.log = append(s.log, changes...)
+	if n := len(s.log) - changeLog; n > 0 {
+		s.logFloor = s.log[n-1].Version
+		s.log = slices.Delete(s.log, 0, n)
+	}
+	for ch := range s.feeds {
+		for _, c := range changes {
+			select {
+			case ch <- c:
+				continue
+			default:
+			}
+			delete(s.feeds, ch)
+			close(ch)
+			break
+		}
+	}
+}
+
+// clone copies sn so the copy can be modified.
+func (sn *snapshot) clone() *snapshot {
+	return &snapshot{
+		version:     sn.version,
+		posts:       slices.Clone(sn.posts),
+		comments:    slices.Clone(sn.comments),
+		users:       slices.Clone(sn.users),
+		modified:    maps.Clone(sn.modified),
+		typeVersion: maps.Clone(sn.typeVersion),
+		deleted:     maps.Clone(sn.deleted),
+	}
+}
+
+// bump starts a new version in which the given entities changed.
+func (sn *snapshot) bump(entity string, ids ...string) {
+	sn.version++
+	sn.typeVersion[entity] = sn.version
+	for _, id := range ids {
+		sn.modified[entityKey(entity, id)] = sn.version
+	}
+}
+
+// PostsSince returns the posts that changed after version since; 0 returns
+// all of them.
+func (sn *snapshot) PostsSince(since uint64) []Post {
+	return changedSince(sn, "post", since, sn.posts, func(p Post) string { return p.ID })
+}
+
+func (sn *snapshot) CommentsSince(since uint64) []Comment {
+	return changedSince(sn, "comment", since, sn.comments, func(c Comment) string { return c.ID })
+}
+
+func (sn *snapshot) UsersSince(since uint64) []User {
+	return changedSince(sn, "user", since, sn.users, func(u User) string { return u.ID })
+}
+
+func (sn *snapshot) Posts() []Post       { return sn.PostsSince(0) }
+func (sn *snapshot) Comments() []Comment { return sn.CommentsSince(0) }
+func (sn *snapshot) Users() []User       { return sn.UsersSince(0) }
+
+// changedSince copies the items modified after since.
+func changedSince[T any](sn *snapshot, entity string, since uint64, items []T, id func(T) string) []T {
+	changed := make([]T, 0, len(items))
+	for _, item := range items {
+		if sn.modified[entityKey(entity, id(item))] > since {
+			changed = append(changed, item)
+		}
+	}
+	return changed
+}
+
+// TombstonesSince returns the deletions after version since, in the order
+// they happened. Entities that have been created again have none.
+func (sn *snapshot) TombstonesSince(since uint64) []tombstone {
+	var ts []tombstone
+	for _, t := range sn.deleted {
+		if t.Version > since {
+			ts = append(ts, t)
+		}
+	}
+	// Within a version, the deleted entity comes before those it cascaded to.
+	cascaded := func(t tombstone) bool { return t.Cause != "" }
+	slices.SortFunc(ts, func(a, b tombstone) int {
+		return cmp.Or(cmp.Compare(a.Version, b.Version), compareBool(cascaded(a), cascaded(b)),
+			cmp.Compare(a.Entity, b.Entity), cmp.Compare(a.ID, b.ID))
+	})
+	return ts
+}
+
+func (p Post) validate() error {
+	if p.ID == "" {
+		return errors.New("post has no id")
+	}
+	if p.Data == "" {
+		return fmt.Errorf("post %s has no data", p.ID)
+	}
+	return nil
+}
+
+func (c Comment) validate() error {
+	if c.ID == "" {
+		return errors.New("comment has no id")
+	}
+	if c.Text == "" {
+		return fmt.Errorf("comment %s has no text", c.ID)
+	}
+	if c.User == "" {
+		return fmt.Errorf("comment %s has no user", c.ID)
+	}
+	return nil
+}
+
+func (u User) validate() error {
+	if u.ID == "" {
+		return errors.New("user has no id")
+	}
+	if u.Name == "" {
+		return fmt.Errorf("user %s has no name", u.ID)
+	}
+	return nil
+}
+
+// conflictError reports a write that names a version other than the entity's
+// current one.
+type conflictError struct {
+	Entity, ID string
+	Want       uint64 // the version the write replaces
+	Have       uint64 // the current version, 0 if there is no such entity
+}
+
+func (e *conflictError) Error() string {
+	switch {
+	case e.Have == 0:
+		return fmt.Sprintf("%s %s does not exist", e.Entity, e.ID)
+	case e.Want == 0:
+		return fmt.Sprintf("%s %s already exists at version %d", e.Entity, e.ID, e.Have)
+	}
+	return fmt.Sprintf("%s %s is at version %d, not %d", e.Entity, e.ID, e.Have, e.Want)
+}
+
+var errNotFound = errors.New("not found")
+
+// check returns a conflictError unless version is the entity's current one.
+func (sn *snapshot) check(entity, id string, version uint64) error {
+	var have uint64
+	if _, ok := sn.get(entity, id); ok {
+		have = sn.modified[entityKey(entity, id)]
+	}
+	if version != have {
+		return &conflictError{Entity: entity, ID: id, Want: version, Have: have}
+	}
+	return nil
+}
+
+// PutPosts inserts or replaces posts, each of which must carry the version it
+// replaces. Either all of them are applied or, if one is invalid or out of
+// date, none are. It returns the version written.
+func (s *store) PutPosts(ps ...Post) (uint64, error) {
+	for _, p := range ps {
+		if err := p.validate(); err != nil {
+			return 0, err
+		}
+	}
+	if len(ps) == 0 {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range ps {
+		if err := s.cur.check("post", p.ID, p.Version); err != nil {
+			return 0, err
+		}
+	}
+	next := s.cur.clone()
+	next.bump("post", ids(ps, func(p Post) string { return p.ID })...)
+	changes := make([]change, len(ps))
+	for i, p := range ps {
+		p.Version = next.version
+		var prev Post
+		var existed bool
+		next.posts, prev, existed = upsert(next.posts, p, func(q Post) bool { return q.ID == p.ID })
+		changes[i] = change{Entity: "post", ID: p.ID, Version: next.version, New: p}
+		// A deleted entity that is written again counts as created.
+		if !next.undelete("post", p.ID) && existed {
+			changes[i].Old = prev
+		}
+	}
+	s.commit(next, changes...)
+	return next.version, nil
+}
+
+// PutComments inserts or replaces comments like PutPosts. Their users must
+// already exist.
+func (s *store) PutComments(cs ...Comment) (uint64, error) {
+	for _, c := range cs {
+		if err := c.validate(); err != nil {
+			return 0, err
+		}
+	}
+	if len(cs) == 0 {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range cs {
+		if _, ok := s.cur.get("user", c.User); !ok {
+			return 0, fmt.Errorf("comment %s refers to unknown user %s", c.ID, c.User)
+		}
+		if err := s.cur.check("comment", c.ID, c.Version); err != nil {
+			return 0, err
+		}
+	}
+	next := s.cur.clone()
+	next.bump("comment", ids(cs, func(c Comment) string { return c.ID })...)
+	changes := make([]change, len(cs))
+	for i, c := range cs {
+		c.Version = next.version
+		var prev Comment
+		var existed bool
+		next.comments, prev, existed = upsert(next.comments, c, func(d Comment) bool { return d.ID == c.ID })
+		changes[i] = change{Entity: "comment", ID: c.ID, Version: next.version, New: c}
+		if !next.undelete("comment", c.ID) && existed {
+			changes[i].Old = prev
+		}
+	}
+	s.commit(next, changes...)
+	return next.version, nil
+}
+
+// PutUsers inserts or replaces users like PutPosts.
+func (s *store) PutUsers(us ...User) (uint64, error) {
+	for _, u := range us {
+		if err := u.validate(); err != nil {
+			return 0, err
+		}
+	}
+	if len(us) == 0 {
+		return 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range us {
+		if err := s.cur.check("user", u.ID, u.Version); err != nil {
+			return 0, err
+		}
+	}
+	next := s.cur.clone()
+	next.bump("user", ids(us, func(u User) string { return u.ID })...)
+	changes := make([]change, len(us))
+	for i, u := range us {
+		u.Version = next.version
+		var prev User
+		var existed bool
+		next.users, prev, existed = upsert(next.users, u, func(v User) bool { return v.ID == u.ID })
+		changes[i] = change{Entity: "user", ID: u.ID, Version: next.version, New: u}
+		if !next.undelete("user", u.ID) && existed {
+			changes[i].Old = prev
+		}
+	}
+	s.commit(next, changes...)
+	return next.version, nil
+}
+
+// Delete soft-deletes the entity at version and the comments that belong to
+// it, if it is a post or a user, recording a tombstone for each. It returns
+// errNotFound if there is no such entity and a conflictError if it is at
+// another version.
+func (s *store) Delete(entity, id string, version uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.cur.get(entity, id)
+	if !ok {
+		return errNotFound
+	}
+	if err := s.cur.check(entity, id, version); err != nil {
+		return err
+	}
+	next := s.cur.clone()
+	next.bump(entity)
+	changes := []change{next.tombstone(entity, id, "", old)}
+	var cascade []string
+	switch old := old.(type) {
+	case Post:
+		cascade = old.Comments
+	case User:
+		for _, c := range next.comments {
+			if c.User == id {
+				cascade = append(cascade, c.ID)
+			}
+		}
+	}
+	for _, cid := range cascade {
+		if c, ok := next.get("comment", cid); ok {
+			changes = append(changes, next.tombstone("comment", cid, entityKey(entity, id), c))
+		}
+	}
+	if len(changes) > 1 {
+		next.typeVersion["comment"] = next.version
+	}
+	s.commit(next, changes...)
+	return nil
+}
+
+// get returns the entity if it exists and is not deleted.
+func (sn *snapshot) get(entity, id string) (any, bool) {
+	if _, deleted := sn.deleted[entityKey(entity, id)]; deleted {
+		return nil, false
+	}
+	switch entity {
+	case "post":
+		return find(sn.posts, func(p Post) bool { return p.ID == id })
+	case "comment":
+		return find(sn.comments, func(c Comment) bool { return c.ID == id })
+	case "user":
+		return find(sn.users, func(u User) bool { return u.ID == id })
+	}
+	return nil, false
+}
+
+// tombstone marks an entity deleted in the snapshot's version.
+func (sn *snapshot) tombstone(entity, id, cause string, old any) change {
+	key := entityKey(entity, id)
+	delete(sn.modified, key)
+	sn.deleted[key] = tombstone{Type: "tombstone", Entity: entity, ID: id, Version: sn.version, Cause: cause}
+	return change{Entity: entity, ID: id, Version: sn.version, Old: old, Cause: cause}
+}
+
+// undelete clears the tombstone of an entity that is written again, reporting
+// whether there was one.
+func (sn *snapshot) undelete(entity, id string) bool {
+	key := entityKey(entity, id)
+	_, deleted := sn.deleted[key]
+	delete(sn.deleted, key)
+	return deleted
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	}
+	return -1
+}
+
+func ids[T any](items []T, id func(T) string) []string {
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = id(item)
+	}
+	return ids
+}
+
+func find[T any](items []T, match func(T) bool) (any, bool) {
+	if i := slices.IndexFunc(items, match); i >= 0 {
+		return items[i], true
+	}
+	return nil, false
+}
+
+// upsert replaces the first item that matches, returning the one it replaced,
+// or appends item if none does.
+func upsert[T any](items []T, item T, match func(T) bool) ([]T, T, bool) {
+	if i := slices.IndexFunc(items, match); i >= 0 {
+		old := items[i]
+		items[i] = item
+		return items, old, true
+	}
+	var zero T
+	return append(items, item), zero, false
+}
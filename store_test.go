@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A subscriber that starts from a snapshot's version, while writes go on,
+// sees every later write exactly once, and the snapshot with those writes
+// applied is the store's final state.
+func TestSubscribeHandoff(t *testing.T) {
+	s := newStore(posts, comments, users)
+	const writers, writes, subscribers = 4, 100, 8
+	final := uint64(1 + writers*writes)
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := posts[w]
+			p.Version = 1
+			for i := range writes {
+				p.Data = string(rune('a' + i%26))
+				v, err := s.PutPosts(p)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				p.Version = v
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	for i := range subscribers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Start at different points of the writes.
+			for s.snapshot().version < uint64(1+i*writers*writes/subscribers) {
+				runtime.Gosched()
+			}
+			snap := s.snapshot()
+			// Some writes land between the snapshot and the subscription.
+			for s.snapshot().version < min(snap.version+writers, final) {
+				runtime.Gosched()
+			}
+			changes, unsubscribe, err := s.subscribe(snap.version, writers*writes)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer unsubscribe()
+			state := make(map[string]Post)
+			for _, p := range snap.Posts() {
+				state[p.ID] = p
+			}
+			for version := snap.version; version < final; {
+				var c change
+				var ok bool
+				select {
+				case c, ok = <-changes:
+				case <-time.After(5 * time.Second):
+					t.Errorf("feed from %d stopped at %d", snap.version, version)
+					return
+				}
+				if !ok {
+					t.Errorf("feed from %d closed at %d", snap.version, version)
+					return
+				}
+				if c.Version != version+1 {
+					t.Errorf("feed from %d: version %d after %d", snap.version, c.Version, version)
+					return
+				}
+				if !reflect.DeepEqual(c.Old, state[c.ID]) {
+					t.Errorf("feed from %d: change %d is to %v, want %v", snap.version, c.Version, c.Old, state[c.ID])
+					return
+				}
+				state[c.ID], version = c.New.(Post), c.Version
+			}
+			for _, p := range s.snapshot().Posts() {
+				if !reflect.DeepEqual(state[p.ID], p) {
+					t.Errorf("feed from %d: %s = %v, want %v", snap.version, p.ID, state[p.ID], p)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// A view reads the data as of its snapshot, however the store changes while
+// the producers go through it.
+func TestViewReadsSnapshot(t *testing.T) {
+	saved := emitLatency
+	emitLatency = time.Millisecond
+	defer func() { emitLatency = saved }()
+	s := newStore(posts, comments, users)
+	v := view{snap: s.snapshot()}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			sn := s.snapshot()
+			p, c := sn.posts[i%len(sn.posts)], sn.comments[i%len(sn.comments)]
+			p.Data, c.Text = "changed", "changed"
+			if _, err := s.PutPosts(p); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := s.PutComments(c); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	postCh, commentCh := make(chan Item[Post]), make(chan Item[Comment])
+	go func() { v.getPosts(t.Context(), 0, postCh); close(postCh) }()
+	go func() { v.getComments(t.Context(), 0, commentCh); close(commentCh) }()
+	var got []any
+	for postCh != nil || commentCh != nil {
+		select {
+		case it, ok := <-postCh:
+			if !ok {
+				postCh = nil
+				continue
+			}
+			got = append(got, it.Value)
+		case it, ok := <-commentCh:
+			if !ok {
+				commentCh = nil
+				continue
+			}
+			got = append(got, it.Value)
+		}
+	}
+	close(stop)
+	<-done
+
+	if s.snapshot().version == v.snap.version {
+		t.Fatal("nothing was written while the view was read")
+	}
+	if len(got) != len(posts)+len(comments) {
+		t.Fatalf("read %d entities, want %d", len(got), len(posts)+len(comments))
+	}
+	for _, e := range got {
+		switch e := e.(type) {
+		case Post:
+			if e.Version != 1 || e.Data == "changed" {
+				t.Errorf("read %v, which is not in the snapshot", e)
+			}
+		case Comment:
+			if e.Version != 1 || e.Text == "changed" {
+				t.Errorf("read %v, which is not in the snapshot", e)
+			}
+		}
+	}
+}
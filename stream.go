@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Item is a value on its way to the client together with the metadata needed
+// to frame it: the entity type, its id and any extra part headers. Items
+// without an id are control parts, like status parts, and are sent as is.
+type Item[T any] struct {
+	Type   string
+	ID     string
+	Header http.Header
+	Value  T
+}
+
+// Stream is a channel of items. The sender closes it when it is done.
+type Stream[T any] <-chan Item[T]
+
+// Source produces the items of one kind. Run skips the first offset items,
+// then sends the rest on ch until it is done or ctx is canceled; it does not
+// close ch.
+type Source[T any] struct {
+	Name string
+	Run  func(ctx context.Context, offset int, ch chan<- Item[T]) error
+}
+
+// Untyped erases the item type of a source so that sources of different types
+// can be merged into one stream.
+func Untyped[T any](src Source[T]) Source[any] {
+	return Source[any]{Name: src.Name, Run: func(ctx context.Context, offset int, ch chan<- Item[any]) error {
+		typed := make(chan Item[T])
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- src.Run(ctx, offset, typed)
+			close(typed)
+		}()
+		for it := range Map(ctx, typed, func(it Item[T]) Item[any] {
+			return Item[any]{Type: it.Type, ID: it.ID, Header: it.Header, Value: it.Value}
+		}) {
+			select {
+			case ch <- it:
+			case <-ctx.Done():
+			}
+		}
+		return <-errCh
+	}}
+}
+
+// Limit stops src once it has sent its first n items, which counts as
+// finishing.
+func Limit[T any](src Source[T], n int) Source[T] {
+	return Source[T]{Name: src.Name, Run: func(ctx context.Context, offset int, ch chan<- Item[T]) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		in := make(chan Item[T])
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- src.Run(ctx, offset, in)
+			close(in)
+		}()
+		sent := offset
+		for it := range Take(ctx, in, n-offset) {
+			if !forward(ctx, ch, it) {
+				return ctx.Err()
+			}
+			sent++
+		}
+		if sent >= n {
+			return nil
+		}
+		return <-errCh
+	}}
+}
+
+// forward sends it on out unless ctx is done first.
+func forward[T any](ctx context.Context, out chan<- T, it T) bool {
+	select {
+	case out <- it:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// drain discards what is left of in so its sender can finish.
+func drain[T any](in <-chan T) {
+	for range in {
+	}
+}
+
+// Map applies f to every item of in.
+func Map[T, U any](ctx context.Context, in <-chan Item[T], f func(Item[T]) Item[U]) Stream[U] {
+	out := make(chan Item[U])
+	go func() {
+		defer close(out)
+		defer drain(in)
+		for it := range in {
+			if !forward(ctx, out, f(it)) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// FlatMap replaces every item of in with the items f returns for it.
+func FlatMap[T, U any](ctx context.Context, in <-chan Item[T], f func(Item[T]) []Item[U]) Stream[U] {
+	out := make(chan Item[U])
+	go func() {
+		defer close(out)
+		defer drain(in)
+		for it := range in {
+			for _, u := range f(it) {
+				if !forward(ctx, out, u) {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// Filter passes on the items of in for which keep returns true.
+func Filter[T any](ctx context.Context, in <-chan Item[T], keep func(Item[T]) bool) Stream[T] {
+	out := make(chan Item[T])
+	go func() {
+		defer close(out)
+		defer drain(in)
+		for it := range in {
+			if keep(it) && !forward(ctx, out, it) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Take passes on the first n items of in and closes as soon as it has, without
+// waiting for in to end; the rest of in is discarded. Cancel the context of
+// in's sender to stop it early.
+func Take[T any](ctx context.Context, in <-chan Item[T], n int) Stream[T] {
+	out := make(chan Item[T])
+	go func() {
+		defer close(out)
+		defer func() { go drain(in) }()
+		for ; n > 0; n-- {
+			select {
+			case it, ok := <-in:
+				if !ok || !forward(ctx, out, it) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Batch groups consecutive items of in according to p. Items for which
+// batchable returns false flush the pending batch and are passed on alone.
+// Each batch is sent as an item of the type of its contents.
+func Batch[T any](ctx context.Context, in <-chan Item[T], p batchPolicy, batchable func(Item[T]) bool) Stream[[]Item[T]] {
+	out := make(chan Item[[]Item[T]])
+	go func() {
+		defer close(out)
+		defer drain(in)
+
+		var batch []Item[T]
+		size := 0
+		timer := time.NewTimer(0)
+		timer.Stop()
+		flush := func() bool {
+			if batch == nil {
+				return true
+			}
+			timer.Stop()
+			ok := forward(ctx, out, Item[[]Item[T]]{Type: batch[0].Type, Value: batch})
+			batch, size = nil, 0
+			return ok
+		}
+
+		for {
+			select {
+			case it, ok := <-in:
+				if !ok {
+					flush()
+					return
+				}
+				if !batchable(it) || (batch != nil && it.Type != batch[0].Type) {
+					if !flush() || !forward(ctx, out, Item[[]Item[T]]{Type: it.Type, Value: []Item[T]{it}}) {
+						return
+					}
+					continue
+				}
+				if batch == nil && p.linger > 0 {
+					timer.Reset(p.linger)
+				}
+				batch = append(batch, it)
+				if p.maxBytes > 0 {
+					size += encodedSize(it.ID, it.Value)
+				}
+				if (p.maxItems > 0 && len(batch) >= p.maxItems) || (p.maxBytes > 0 && size >= p.maxBytes) {
+					if !flush() {
+						return
+					}
+				}
+			case <-timer.C:
+				if !flush() {
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// Concat sends all of each stream in turn. A stream waiting for its turn holds
+// back its producer.
+func Concat[T any](ctx context.Context, streams ...Stream[T]) Stream[T] {
+	out := make(chan Item[T])
+	go func() {
+		defer close(out)
+		for i, in := range streams {
+			for it := range in {
+				if !forward(ctx, out, it) {
+					for _, rest := range streams[i:] {
+						drain(rest)
+					}
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// Merge combines the named streams into one, ordered by sched. Queues of sched
+// without a stream are finished right away. When sched refuses an item because
+// the client is too slow, fail is called.
+func Merge[T any](ctx context.Context, sched *scheduler[T], streams map[string]Stream[T], fail func(error)) Stream[T] {
+	for _, q := range sched.queues {
+		if _, ok := streams[q.name]; !ok {
+			sched.finish(q.name)
+		}
+	}
+	for name, in := range streams {
+		go func() {
+			defer sched.finish(name)
+			// Once ctx is done push fails fast, which keeps draining in.
+			for it := range in {
+				if err := sched.push(ctx, name, it); err != nil && ctx.Err() == nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+	out := make(chan Item[T])
+	go func() {
+		defer close(out)
+		for {
+			it, ok := sched.next(ctx)
+			if !ok || !forward(ctx, out, it) {
+				return
+			}
+		}
+	}()
+	return out
+}
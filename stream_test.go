@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func batchSizes(t *testing.T, p batchPolicy, gap time.Duration, n int) []int {
+	t.Helper()
+	in := make(chan Item[any])
+	go func() {
+		defer close(in)
+		for i := range n {
+			time.Sleep(gap)
+			in <- Item[any]{Type: "comment", ID: string(rune('a' + i)), Value: i}
+		}
+	}()
+	var sizes []int
+	for batch := range Batch(context.Background(), in, p, func(Item[any]) bool { return true }) {
+		sizes = append(sizes, len(batch.Value))
+	}
+	return sizes
+}
+
+func TestBatchWithoutLinger(t *testing.T) {
+	// Without a linger, items slow to arrive still wait for a full batch.
+	got := batchSizes(t, batchPolicy{maxItems: 3}, 10*time.Millisecond, 5)
+	if want := []int{3, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("batch sizes = %v, want %v", got, want)
+	}
+}
+
+func TestBatchLinger(t *testing.T) {
+	got := batchSizes(t, batchPolicy{maxItems: 3, linger: 5 * time.Millisecond}, 30*time.Millisecond, 3)
+	if want := []int{1, 1, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("batch sizes = %v, want %v", got, want)
+	}
+}
+
+func TestBatchSingleItems(t *testing.T) {
+	got := batchSizes(t, batchPolicy{maxItems: 1}, 0, 3)
+	if want := []int{1, 1, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("batch sizes = %v, want %v", got, want)
+	}
+}
+
+// counter is a source of the items 0, 1, 2, ... that runs until it is stopped,
+// and reports on stopped when it has.
+func counter(stopped chan<- error) Source[int] {
+	return Source[int]{Name: "counter", Run: func(ctx context.Context, offset int, ch chan<- Item[int]) error {
+		for i := offset; ; i++ {
+			if !forward(ctx, ch, Item[int]{Type: "counter", Value: i}) {
+				stopped <- ctx.Err()
+				return ctx.Err()
+			}
+		}
+	}}
+}
+
+func values(s Stream[int]) []int {
+	var vs []int
+	for it := range s {
+		vs = append(vs, it.Value)
+	}
+	return vs
+}
+
+func TestTake(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	in := make(chan Item[int])
+	stopped := make(chan error, 1)
+	go counter(stopped).Run(ctx, 0, in)
+	// Take ends once it has n items, although in goes on.
+	if got, want := values(Take(t.Context(), in, 3)), []int{0, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Take = %v, want %v", got, want)
+	}
+	cancel()
+	<-stopped
+
+	short := make(chan Item[int], 2)
+	short <- Item[int]{Value: 1}
+	short <- Item[int]{Value: 2}
+	close(short)
+	if got, want := values(Take(t.Context(), short, 5)), []int{1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Take of a shorter stream = %v, want %v", got, want)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	for _, offset := range []int{0, 2, 4} {
+		stopped := make(chan error, 1)
+		ch := make(chan Item[int])
+		var err error
+		go func() {
+			err = Limit(counter(stopped), 4).Run(t.Context(), offset, ch)
+			close(ch)
+		}()
+		got := values(ch)
+		if err != nil {
+			t.Errorf("offset %d: %v", offset, err)
+		}
+		if want := []int{0, 1, 2, 3}[offset:]; !slices.Equal(got, want) {
+			t.Errorf("offset %d: items = %v, want %v", offset, got, want)
+		}
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Errorf("offset %d: the source was not stopped", offset)
+		}
+	}
+}
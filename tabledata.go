@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tableConfig describes the synthetic workload behind /table-data.
+type tableConfig struct {
+	Rows     int     `json:"rows"`
+	Work     int     `json:"work"`     // hash rounds per row
+	Variance float64 `json:"variance"` // 0..1, how much the cost differs between rows
+	Ordered  bool    `json:"ordered"`  // emit rows in index order instead of as completed
+}
+
+type tableRow struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	Index     int    `json:"index"`
+	Data      string `json:"data"`
+	Status    string `json:"status"`
+	Rounds    int    `json:"rounds"`
+	ElapsedMS int64  `json:"elapsedMs"`
+}
+
+func defaultTableConfig() tableConfig {
+	return tableConfig{Rows: 50, Work: 200000, Variance: 0.5}
+}
+
+func parseTableConfig(q url.Values) (tableConfig, error) {
+	cfg := defaultTableConfig()
+	var err error
+	if v := q.Get("rows"); v != "" {
+		if cfg.Rows, err = strconv.Atoi(v); err != nil || cfg.Rows < 0 {
+			return cfg, fmt.Errorf("invalid rows %q", v)
+		}
+	}
+	if v := q.Get("work"); v != "" {
+		if cfg.Work, err = strconv.Atoi(v); err != nil || cfg.Work < 0 {
+			return cfg, fmt.Errorf("invalid work %q", v)
+		}
+	}
+	if v := q.Get("variance"); v != "" {
+		if cfg.Variance, err = strconv.ParseFloat(v, 64); err != nil || cfg.Variance < 0 || cfg.Variance > 1 {
+			return cfg, fmt.Errorf("invalid variance %q", v)
+		}
+	}
+	switch q.Get("order") {
+	case "", "completed":
+	case "row":
+		cfg.Ordered = true
+	default:
+		return cfg, fmt.Errorf("invalid order %q, want completed or row", q.Get("order"))
+	}
+	return cfg, nil
+}
+
+// rounds returns the number of hash rounds for row i. The spread is
+// deterministic so runs are comparable.
+func (cfg tableConfig) rounds(i int) int {
+	h := fnv.New32a()
+	fmt.Fprint(h, i)
+	frac := float64(h.Sum32()%1000) / 1000
+	return cfg.Work + int(float64(cfg.Work)*cfg.Variance*(2*frac-1))
+}
+
+// performHeavyCalculation hashes the row seed repeatedly. It checks ctx every
+// so often so an abandoned request does not keep a core busy.
+func performHeavyCalculation(ctx context.Context, cfg tableConfig, i int) (tableRow, error) {
+	start := time.Now()
+	rounds := cfg.rounds(i)
+	sum := sha256.Sum256([]byte(strconv.Itoa(i)))
+	for n := 0; n < rounds; n++ {
+		if n%4096 == 0 && ctx.Err() != nil {
+			return tableRow{}, ctx.Err()
+		}
+		sum = sha256.Sum256(sum[:])
+	}
+	return tableRow{
+		Type:      "row",
+		ID:        fmt.Sprintf("row_%d", i+1),
+		Index:     i,
+		Data:      hex.EncodeToString(sum[:8]),
+		Status:    "complete",
+		Rounds:    rounds,
+		ElapsedMS: time.Since(start).Milliseconds(),
+	}, nil
+}
+
+// computeTable runs the workload on a pool of GOMAXPROCS workers and calls emit
+// for each row, either as rows complete or in row order. In row order, the
+// number of rows in flight is capped so the reorder buffer stays bounded when
+// an early row is slow.
+func computeTable(ctx context.Context, cfg tableConfig, emit func(tableRow)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := runtime.GOMAXPROCS(0)
+	window := make(chan struct{}, workers*4)
+	jobs := make(chan int)
+	results := make(chan tableRow, workers)
+
+	go func() {
+		defer close(jobs)
+		for i := 0; i < cfg.Rows; i++ {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				row, err := performHeavyCalculation(ctx, cfg, i)
+				if err != nil {
+					return
+				}
+				select {
+				case results <- row:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[int]tableRow)
+	next := 0
+	for row := range results {
+		if !cfg.Ordered {
+			emit(row)
+			<-window
+			continue
+		}
+		pending[row.Index] = row
+		for {
+			row, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			emit(row)
+			<-window
+			next++
+		}
+	}
+	return ctx.Err()
+}
+
+func streamTableData(w http.ResponseWriter, r *http.Request) {
+	cfg, err := parseTableConfig(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pw, ok := newPartWriter(w, r)
+	if !ok {
+		return
+	}
+
+	err = computeTable(r.Context(), cfg, func(row tableRow) {
+		pw.sendJSON(row)
+	})
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	pw.close()
+}
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// transform is a compiled ?transform= expression. The language is a small
+// subset of jq:
+//
+//	.                    the input
+//	.a.b, .["a b"], .[0] fields and indexes; null has every field, as null
+//	.[]                  every element or value
+//	{a, b: .x, (.k): 1}  objects; {a} is short for {a: .a}
+//	[f]                  an array of the outputs of f
+//	f | g                g applied to every output of f
+//	f, g                 the outputs of f, then those of g
+//	+ - * / %            arithmetic; + also joins strings, arrays and objects
+//	== != < <= > >=      comparisons, ordered like jq across types
+//	and or not           logic; only false and null are false
+//	select(f), length, keys
+//	"text" 1.5 true false null
+//
+// An expression produces any number of outputs for each input.
+type transform func(in any) ([]any, error)
+
+// encodeTransformed encodes the body encodeBatch would send for batch, passed
+// through t, as one part per output. It returns nil if t has no output.
+func encodeTransformed(boundary string, batch []Item[any], t transform) (*partBuffer, error) {
+	var body any = batch[0].Value
+	if batch[0].ID != "" {
+		envelope := map[string]any{"type": batch[0].Type}
+		for _, it := range batch {
+			envelope[it.ID] = it.Value
+		}
+		body = envelope
+	}
+	in, err := toJSONValue(body)
+	if err != nil {
+		return nil, err
+	}
+	outs, err := t(in)
+	if err != nil || len(outs) == 0 {
+		return nil, err
+	}
+	var contentID string
+	if len(batch) == 1 && len(outs) == 1 && batch[0].ID != "" {
+		contentID = entityKey(batch[0].Type, batch[0].ID)
+	}
+	var parts *partBuffer
+	for _, out := range outs {
+		b, err := encodePart(boundary, batch[0].Header, contentID, func(b *partBuffer) error { return b.encode(out) })
+		if err != nil {
+			if parts != nil {
+				parts.release()
+			}
+			return nil, err
+		}
+		if parts == nil {
+			parts = b
+			continue
+		}
+		// Several outputs are sent back to back in one buffer.
+		parts.appendParts(b)
+		b.release()
+	}
+	return parts, nil
+}
+
+func parseTransform(src string) (transform, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	t, err := p.pipe()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at %d", tok, tok.pos)
+	}
+	return t, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokPunct
+	tokIdent
+	tokNumber
+	tokString
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // offset of the token in the expression
+	end  int // offset just past it
+	num  float64
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d", i)
+			}
+			toks = append(toks, token{kind: tokString, text: s, pos: i, end: j + 1})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.' || src[j] == 'e' || src[j] == 'E') {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at %d", src[i:j], i)
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[i:j], pos: i, end: j, num: n})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			toks = append(toks, token{kind: tokIdent, text: src[i:j], pos: i, end: j})
+			i = j
+		default:
+			text := string(c)
+			if i+1 < len(src) && slices.Contains([]string{"==", "!=", "<=", ">="}, src[i:i+2]) {
+				text = src[i : i+2]
+			} else if !strings.ContainsRune(".[]{}()|,:+-*/%<>", rune(c)) {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			toks = append(toks, token{kind: tokPunct, text: text, pos: i, end: i + len(text)})
+			i += len(text)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(src), end: len(src)}), nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the punctuation or keyword text.
+func (p *parser) accept(text string) bool {
+	if t := p.peek(); (t.kind == tokPunct || t.kind == tokIdent) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		t := p.peek()
+		return fmt.Errorf("expected %q, got %s at %d", text, t, t.pos)
+	}
+	return nil
+}
+
+func (p *parser) pipe() (transform, error) {
+	left, err := p.comma()
+	for err == nil && p.accept("|") {
+		var right transform
+		if right, err = p.comma(); err == nil {
+			left = pipeTransform(left, right)
+		}
+	}
+	return left, err
+}
+
+func (p *parser) comma() (transform, error) {
+	left, err := p.or()
+	for err == nil && p.accept(",") {
+		var right transform
+		if right, err = p.or(); err == nil {
+			l := left
+			left = func(in any) ([]any, error) {
+				a, err := l(in)
+				if err != nil {
+					return nil, err
+				}
+				b, err := right(in)
+				return append(a, b...), err
+			}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) or() (transform, error) {
+	left, err := p.and()
+	for err == nil && p.accept("or") {
+		var right transform
+		if right, err = p.and(); err == nil {
+			left = binary(left, right, func(a, b any) (any, error) { return truthy(a) || truthy(b), nil })
+		}
+	}
+	return left, err
+}
+
+func (p *parser) and() (transform, error) {
+	left, err := p.comparison()
+	for err == nil && p.accept("and") {
+		var right transform
+		if right, err = p.comparison(); err == nil {
+			left = binary(left, right, func(a, b any) (any, error) { return truthy(a) && truthy(b), nil })
+		}
+	}
+	return left, err
+}
+
+var comparisons = map[string]func(int) bool{
+	"==": func(c int) bool { return c == 0 },
+	"!=": func(c int) bool { return c != 0 },
+	"<":  func(c int) bool { return c < 0 },
+	"<=": func(c int) bool { return c <= 0 },
+	">":  func(c int) bool { return c > 0 },
+	">=": func(c int) bool { return c >= 0 },
+}
+
+func (p *parser) comparison() (transform, error) {
+	left, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	test, ok := comparisons[t.text]
+	if t.kind != tokPunct || !ok {
+		return left, nil
+	}
+	p.next()
+	right, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	return binary(left, right, func(a, b any) (any, error) { return test(compareJSON(a, b)), nil }), nil
+}
+
+func (p *parser) additive() (transform, error) {
+	left, err := p.multiplicative()
+	for err == nil && (p.peek().text == "+" || p.peek().text == "-") && p.peek().kind == tokPunct {
+		op := p.next().text
+		var right transform
+		if right, err = p.multiplicative(); err == nil {
+			left = binary(left, right, func(a, b any) (any, error) { return arithmetic(op, a, b) })
+		}
+	}
+	return left, err
+}
+
+func (p *parser) multiplicative() (transform, error) {
+	left, err := p.postfix()
+	for err == nil && strings.Contains("*/%", p.peek().text) && p.peek().kind == tokPunct {
+		op := p.next().text
+		var right transform
+		if right, err = p.postfix(); err == nil {
+			left = binary(left, right, func(a, b any) (any, error) { return arithmetic(op, a, b) })
+		}
+	}
+	return left, err
+}
+
+// keywords are the identifiers that cannot follow a dot as field names; use
+// .["and"] for those.
+var keywords = map[string]bool{"and": true, "or": true, "not": true}
+
+// postfix parses a primary followed by field accesses and indexes.
+func (p *parser) postfix() (transform, error) {
+	t, err := p.primary()
+	for err == nil {
+		// .a .b is not .a.b: a field suffix must follow without a space.
+		if tok := p.peek(); tok.text == "." && tok.pos != p.toks[p.pos-1].end {
+			break
+		}
+		var access transform
+		if access, err = p.access(); access == nil {
+			break
+		}
+		t = pipeTransform(t, access)
+	}
+	return t, err
+}
+
+// access parses one .field, ."field", [index] or [] suffix, or returns nil if
+// there is none.
+func (p *parser) access() (transform, error) {
+	switch tok := p.peek(); {
+	case tok.kind == tokPunct && tok.text == ".":
+		// In ". and true" the dot is the input, not the field "and".
+		if after := p.toks[p.pos+1]; after.pos == tok.end && (after.kind == tokIdent && !keywords[after.text] || after.kind == tokString) {
+			p.pos += 2
+			return fieldTransform(after.text), nil
+		}
+		if after := p.toks[p.pos+1]; after.kind == tokPunct && after.text == "[" {
+			p.pos++
+			return p.access()
+		}
+	case tok.kind == tokPunct && tok.text == "[":
+		p.next()
+		if p.accept("]") {
+			return iterate, nil
+		}
+		index, err := p.pipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return func(in any) ([]any, error) {
+			keys, err := index(in)
+			if err != nil {
+				return nil, err
+			}
+			var out []any
+			for _, k := range keys {
+				v, err := indexJSON(in, k)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, v)
+			}
+			return out, nil
+		}, nil
+	}
+	return nil, nil
+}
+
+func (p *parser) primary() (transform, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		return constant(tok.num), nil
+	case tokString:
+		return constant(tok.text), nil
+	case tokIdent:
+		return p.keyword(tok)
+	case tokEOF:
+		return nil, errors.New("unexpected end of expression")
+	}
+	switch tok.text {
+	case ".":
+		// A lone dot is the identity; .a and .[...] are handled as accesses.
+		p.pos--
+		if access, err := p.access(); access != nil || err != nil {
+			return access, err
+		}
+		p.pos++
+		return identity, nil
+	case "(":
+		t, err := p.pipe()
+		if err != nil {
+			return nil, err
+		}
+		return t, p.expect(")")
+	case "[":
+		if p.accept("]") {
+			return constant([]any{}), nil
+		}
+		t, err := p.pipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return func(in any) ([]any, error) {
+			out, err := t(in)
+			if out == nil {
+				out = []any{}
+			}
+			return []any{out}, err
+		}, nil
+	case "{":
+		return p.object()
+	case "-":
+		operand, err := p.postfix()
+		if err != nil {
+			return nil, err
+		}
+		return binary(constant(0.0), operand, func(a, b any) (any, error) { return arithmetic("-", a, b) }), nil
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", tok, tok.pos)
+}
+
+func (p *parser) keyword(tok token) (transform, error) {
+	switch tok.text {
+	case "true", "false":
+		return constant(tok.text == "true"), nil
+	case "null":
+		return constant(nil), nil
+	case "not":
+		return func(in any) ([]any, error) { return []any{!truthy(in)}, nil }, nil
+	case "length":
+		return func(in any) ([]any, error) {
+			switch v := in.(type) {
+			case nil:
+				return []any{0.0}, nil
+			case string:
+				return []any{float64(len([]rune(v)))}, nil
+			case []any:
+				return []any{float64(len(v))}, nil
+			case map[string]any:
+				return []any{float64(len(v))}, nil
+			case float64:
+				return []any{math.Abs(v)}, nil
+			}
+			return nil, fmt.Errorf("%s has no length", typeName(in))
+		}, nil
+	case "keys":
+		return func(in any) ([]any, error) {
+			switch v := in.(type) {
+			case map[string]any:
+				keys := []any{}
+				for _, k := range slices.Sorted(maps.Keys(v)) {
+					keys = append(keys, k)
+				}
+				return []any{keys}, nil
+			case []any:
+				keys := make([]any, len(v))
+				for i := range v {
+					keys[i] = float64(i)
+				}
+				return []any{keys}, nil
+			}
+			return nil, fmt.Errorf("%s has no keys", typeName(in))
+		}, nil
+	case "select":
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		cond, err := p.pipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return func(in any) ([]any, error) {
+			results, err := cond(in)
+			if err != nil {
+				return nil, err
+			}
+			var out []any
+			for _, r := range results {
+				if truthy(r) {
+					out = append(out, in)
+				}
+			}
+			return out, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown function %s at %d", tok.text, tok.pos)
+}
+
+// object parses the fields of an object after its opening brace.
+func (p *parser) object() (transform, error) {
+	type field struct {
+		key, value transform
+	}
+	var fields []field
+	for !p.accept("}") {
+		if len(fields) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		var f field
+		switch tok := p.next(); {
+		case tok.kind == tokIdent || tok.kind == tokString:
+			f.key = constant(tok.text)
+			f.value = fieldTransform(tok.text)
+		case tok.kind == tokPunct && tok.text == "(":
+			key, err := p.pipe()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			f.key = key
+		default:
+			return nil, fmt.Errorf("expected an object key, got %s at %d", tok, tok.pos)
+		}
+		if p.accept(":") {
+			value, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			f.value = value
+		} else if f.value == nil {
+			return nil, fmt.Errorf("expected \":\" at %d", p.peek().pos)
+		}
+		fields = append(fields, f)
+	}
+	return func(in any) ([]any, error) {
+		// Every combination of the fields' outputs makes an object.
+		objects := []map[string]any{{}}
+		for _, f := range fields {
+			keys, err := f.key(in)
+			if err != nil {
+				return nil, err
+			}
+			values, err := f.value(in)
+			if err != nil {
+				return nil, err
+			}
+			var next []map[string]any
+			for _, o := range objects {
+				for _, k := range keys {
+					ks, ok := k.(string)
+					if !ok {
+						return nil, fmt.Errorf("object key must be a string, not %s", typeName(k))
+					}
+					for _, v := range values {
+						o2 := maps.Clone(o)
+						o2[ks] = v
+						next = append(next, o2)
+					}
+				}
+			}
+			objects = next
+		}
+		out := make([]any, len(objects))
+		for i, o := range objects {
+			out[i] = o
+		}
+		return out, nil
+	}, nil
+}
+
+func identity(in any) ([]any, error) { return []any{in}, nil }
+
+func constant(v any) transform {
+	return func(any) ([]any, error) { return []any{v}, nil }
+}
+
+func pipeTransform(left, right transform) transform {
+	return func(in any) ([]any, error) {
+		mid, err := left(in)
+		if err != nil {
+			return nil, err
+		}
+		var out []any
+		for _, v := range mid {
+			r, err := right(v)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, r...)
+		}
+		return out, nil
+	}
+}
+
+// binary applies op to every pair of outputs of left and right.
+func binary(left, right transform, op func(a, b any) (any, error)) transform {
+	return func(in any) ([]any, error) {
+		as, err := left(in)
+		if err != nil {
+			return nil, err
+		}
+		bs, err := right(in)
+		if err != nil {
+			return nil, err
+		}
+		var out []any
+		for _, b := range bs {
+			for _, a := range as {
+				v, err := op(a, b)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, v)
+			}
+		}
+		return out, nil
+	}
+}
+
+func fieldTransform(name string) transform {
+	return func(in any) ([]any, error) {
+		v, err := indexJSON(in, name)
+		return []any{v}, err
+	}
+}
+
+func iterate(in any) ([]any, error) {
+	switch v := in.(type) {
+	case []any:
+		return v, nil
+	case map[string]any:
+		out := make([]any, 0, len(v))
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			out = append(out, v[k])
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("cannot iterate over %s", typeName(in))
+}
+
+func indexJSON(in, key any) (any, error) {
+	switch v := in.(type) {
+	case nil:
+		return nil, nil
+	case map[string]any:
+		if k, ok := key.(string); ok {
+			return v[k], nil
+		}
+	case []any:
+		if k, ok := key.(float64); ok {
+			i := int(k)
+			if i < 0 {
+				i += len(v)
+			}
+			if i < 0 || i >= len(v) {
+				return nil, nil
+			}
+			return v[i], nil
+		}
+	}
+	return nil, fmt.Errorf("cannot index %s with %s", typeName(in), typeName(key))
+}
+
+func arithmetic(op string, a, b any) (any, error) {
+	if x, ok := a.(float64); ok {
+		if y, ok := b.(float64); ok {
+			switch op {
+			case "+":
+				return x + y, nil
+			case "-":
+				return x - y, nil
+			case "*":
+				return x * y, nil
+			case "/":
+				if y == 0 {
+					return nil, errors.New("division by zero")
+				}
+				return x / y, nil
+			case "%":
+				// Like jq, % works on the integer parts, so a divisor
+				// between -1 and 1 is zero.
+				if int64(y) == 0 {
+					return nil, errors.New("division by zero")
+				}
+				return float64(int64(x) % int64(y)), nil
+			}
+		}
+	}
+	if op == "+" {
+		switch x := a.(type) {
+		case nil:
+			return b, nil
+		case string:
+			if y, ok := b.(string); ok {
+				return x + y, nil
+			}
+		case []any:
+			if y, ok := b.([]any); ok {
+				return append(slices.Clone(x), y...), nil
+			}
+		case map[string]any:
+			if y, ok := b.(map[string]any); ok {
+				z := maps.Clone(x)
+				maps.Copy(z, y)
+				return z, nil
+			}
+		}
+		if b == nil {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot apply %s to %s and %s", op, typeName(a), typeName(b))
+}
+
+func truthy(v any) bool {
+	return v != nil && v != false
+}
+
+// compareJSON orders values like jq: null, false, true, numbers, strings,
+// arrays, objects.
+func compareJSON(a, b any) int {
+	if c := cmp.Compare(typeRank(a), typeRank(b)); c != 0 {
+		return c
+	}
+	switch x := a.(type) {
+	case bool:
+		return compareBool(x, b.(bool))
+	case float64:
+		return cmp.Compare(x, b.(float64))
+	case string:
+		return strings.Compare(x, b.(string))
+	case []any:
+		return slices.CompareFunc(x, b.([]any), compareJSON)
+	case map[string]any:
+		y := b.(map[string]any)
+		xk, yk := slices.Sorted(maps.Keys(x)), slices.Sorted(maps.Keys(y))
+		if c := slices.Compare(xk, yk); c != 0 {
+			return c
+		}
+		for _, k := range xk {
+			if c := compareJSON(x[k], y[k]); c != 0 {
+				return c
+			}
+		}
+	}
+	return 0
+}
+
+func typeRank(v any) int {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case bool:
+		if !v {
+			return 1
+		}
+		return 2
+	case float64:
+		return 3
+	case string:
+		return 4
+	case []any:
+		return 5
+	}
+	return 6
+}
+
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	}
+	return "object"
+}
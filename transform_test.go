@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func evalTransform(t *testing.T, expr, input string) ([]any, error) {
+	t.Helper()
+	f, err := parseTransform(expr)
+	if err != nil {
+		t.Fatalf("parseTransform(%q): %v", expr, err)
+	}
+	var in any
+	if err := json.Unmarshal([]byte(input), &in); err != nil {
+		t.Fatal(err)
+	}
+	return f(in)
+}
+
+func TestTransformArithmetic(t *testing.T) {
+	tests := []struct {
+		expr string
+		want any
+	}{
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"7 / 2", 3.5},
+		{"7 % 2", 1.0},
+		{"-7 % 2", -1.0},
+		{"7.9 % 2.5", 1.0},
+		{`"a" + "b"`, "ab"},
+		{"null + 1", 1.0},
+		{"[1] + [2]", []any{1.0, 2.0}},
+	}
+	for _, tt := range tests {
+		got, err := evalTransform(t, tt.expr, "null")
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if len(got) != 1 || !reflect.DeepEqual(got[0], tt.want) {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestTransformDivisionByZero(t *testing.T) {
+	for _, expr := range []string{"1 / 0", "1 % 0", "1 % 0.5", "1 % -0.5"} {
+		if _, err := evalTransform(t, expr, "null"); err == nil {
+			t.Errorf("%s: no error", expr)
+		}
+	}
+}
+
+// A transform that fails must drop the part, not take the server down: it
+// runs outside the handler's goroutine, where a panic is not recovered.
+func TestStreamTransformDivisionByZero(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/stream?limit=1&transform=" + url.QueryEscape("1 % 0.5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(body), "--"+boundary+"--\r\n") {
+		t.Errorf("stream did not end cleanly: %q", body)
+	}
+}
+
+func TestTransformParse(t *testing.T) {
+	const input = `{"type":"post","p1":{"id":"p1","comments":["c1","c2"],"version":3},"a b":[1,2,3],"and":true}`
+	tests := []struct {
+		expr string
+		want []any
+	}{
+		{". and true", []any{true}},
+		{". or .x", []any{true}},
+		{".x or .p1", []any{true}},
+		{"not", []any{false}},
+		{".p1.id", []any{"p1"}},
+		{`.p1."id"`, []any{"p1"}},
+		{`.["a b"][1]`, []any{2.0}},
+		{".p1.comments[]", []any{"c1", "c2"}},
+		{`.["and"]`, []any{true}},
+		{".p1 | .version >= 3 and .id == \"p1\"", []any{true}},
+		{"select(.type == \"comment\")", nil},
+		{"{type, v: .p1.version}", []any{map[string]any{"type": "post", "v": 3.0}}},
+		{"(1, 2) * 10", []any{10.0, 20.0}},
+		{".missing.deeper", []any{nil}},
+	}
+	for _, tt := range tests {
+		got, err := evalTransform(t, tt.expr, input)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %#v, want %#v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestTransformParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		".a .b",
+		".p1 .id",
+		".and",
+		".a |",
+		"{a: }",
+		"select(.a",
+		`"unterminated`,
+		"unknown",
+		". ;",
+	} {
+		if _, err := parseTransform(expr); err == nil {
+			t.Errorf("parseTransform(%q) succeeded", expr)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultUpstreamTimeout = 10 * time.Second
+
+// upstream is an HTTP endpoint serving one entity type.
+type upstream struct {
+	name    string
+	format  string // json (array), ndjson or multipart
+	url     string
+	timeout time.Duration
+}
+
+var (
+	upstreams      upstreamFlags
+	forwardHeaders headerFlags
+)
+
+// upstreamFlags collects -upstream flags.
+type upstreamFlags []upstream
+
+func (f *upstreamFlags) String() string {
+	specs := make([]string, len(*f))
+	for i, u := range *f {
+		specs[i] = fmt.Sprintf("%s=%s:%s;timeout=%s", u.name, u.format, u.url, u.timeout)
+	}
+	return strings.Join(specs, " ")
+}
+
+// Set parses name=format:url with an optional ;timeout=<duration> suffix.
+func (f *upstreamFlags) Set(spec string) error {
+	name, rest, ok := strings.Cut(spec, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("invalid upstream %q, want name=format:url", spec)
+	}
+	format, rest, ok := strings.Cut(rest, ":")
+	if !ok {
+		return fmt.Errorf("invalid upstream %q, want name=format:url", spec)
+	}
+	switch format {
+	case "json", "ndjson", "multipart":
+	default:
+		return fmt.Errorf("invalid upstream format %q, want json, ndjson or multipart", format)
+	}
+	u := upstream{name: name, format: format, url: rest, timeout: defaultUpstreamTimeout}
+	if url, opt, ok := strings.Cut(rest, ";"); ok {
+		value, found := strings.CutPrefix(opt, "timeout=")
+		if !found {
+			return fmt.Errorf("invalid upstream option %q", opt)
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid upstream timeout: %w", err)
+		}
+		u.url, u.timeout = url, timeout
+	}
+	*f = append(*f, u)
+	return nil
+}
+
+// headerFlags collects -forward-header flags.
+type headerFlags []string
+
+func (f *headerFlags) String() string { return strings.Join(*f, ",") }
+
+func (f *headerFlags) Set(name string) error {
+	*f = append(*f, http.CanonicalHeaderKey(name))
+	return nil
+}
+
+// source fetches the upstream, copying the forwarded headers from the incoming
+// request, and re-emits its items as they are decoded.
+func (u upstream) source(incoming http.Header, forward []string) Source[json.RawMessage] {
+	return Source[json.RawMessage]{Name: u.name, Run: func(ctx context.Context, offset int, ch chan<- Item[json.RawMessage]) error {
+		ctx, cancel := context.WithTimeout(ctx, u.timeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.url, nil)
+		if err != nil {
+			return err
+		}
+		for _, name := range forward {
+			for _, v := range incoming.Values(name) {
+				req.Header.Add(name, v)
+			}
+		}
+		if u.format == "multipart" {
+			req.Header.Set("Accept", "multipart/mixed")
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("upstream %s returned %s", u.url, resp.Status)
+		}
+
+		send := func(it Item[json.RawMessage]) error {
+			if offset > 0 {
+				offset--
+				return nil
+			}
+			select {
+			case ch <- it:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		switch u.format {
+		case "json":
+			return u.readJSON(resp.Body, send)
+		case "ndjson":
+			return u.readNDJSON(resp.Body, send)
+		default:
+			return u.readMultipart(resp, send)
+		}
+	}}
+}
+
+func (u upstream) readJSON(body io.Reader, send func(Item[json.RawMessage]) error) error {
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return fmt.Errorf("upstream %s did not return a JSON array", u.url)
+	}
+	for dec.More() {
+		var item json.RawMessage
+		if err := dec.Decode(&item); err != nil {
+			return err
+		}
+		if err := u.sendItem(item, send); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u upstream) readNDJSON(body io.Reader, send func(Item[json.RawMessage]) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := u.sendItem(json.RawMessage(line), send); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// readMultipart passes the parts of a multipart/mixed upstream through as is;
+// they are expected to be in the same shape /stream sends.
+func (u upstream) readMultipart(resp *http.Response, send func(Item[json.RawMessage]) error) error {
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return fmt.Errorf("upstream %s did not return multipart", u.url)
+	}
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		mp, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(mp)
+		if err != nil {
+			return err
+		}
+		if err := send(Item[json.RawMessage]{Value: body}); err != nil {
+			return err
+		}
+	}
+}
+
+// sendItem wraps a single entity in the /stream envelope, keyed by its id.
+func (u upstream) sendItem(item json.RawMessage, send func(Item[json.RawMessage]) error) error {
+	var entity struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(item, &entity); err != nil || entity.ID == "" {
+		fmt.Printf("Skipping %s from %s without an id\n", u.name, u.url)
+		return nil
+	}
+	return send(Item[json.RawMessage]{Type: u.name, ID: entity.ID, Value: item})
+}
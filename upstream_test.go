@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fetchUpstream runs the source of u against an incoming request with header
+// and returns the items it sent.
+func fetchUpstream(t *testing.T, u upstream, header http.Header, forward []string, offset int) ([]Item[json.RawMessage], error) {
+	t.Helper()
+	ch := make(chan Item[json.RawMessage])
+	errc := make(chan error, 1)
+	go func() {
+		errc <- u.source(header, forward).Run(t.Context(), offset, ch)
+		close(ch)
+	}()
+	var items []Item[json.RawMessage]
+	for it := range ch {
+		items = append(items, it)
+	}
+	return items, <-errc
+}
+
+func itemIDs(items []Item[json.RawMessage]) []string {
+	ids := make([]string, len(items))
+	for i, it := range items {
+		ids[i] = it.Type + ":" + it.ID
+	}
+	return ids
+}
+
+func TestUpstreamFlag(t *testing.T) {
+	var f upstreamFlags
+	if err := f.Set("post=json:http://posts.internal/posts?x=1;timeout=2s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("user=ndjson:http://users.internal/users"); err != nil {
+		t.Fatal(err)
+	}
+	want := upstreamFlags{
+		{name: "post", format: "json", url: "http://posts.internal/posts?x=1", timeout: 2 * time.Second},
+		{name: "user", format: "ndjson", url: "http://users.internal/users", timeout: defaultUpstreamTimeout},
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("upstreams = %+v, want %+v", f, want)
+	}
+	for _, spec := range []string{
+		"post",
+		"=json:http://x",
+		"post=http://x",
+		"post=xml:http://x",
+		"post=json:http://x;retries=2",
+		"post=json:http://x;timeout=soon",
+	} {
+		if err := f.Set(spec); err == nil {
+			t.Errorf("Set(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestUpstreamJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"id":"p1","title":"a"}, {"title":"no id"}, {"id":"p2","title":"b"}]`)
+	}))
+	defer srv.Close()
+	items, err := fetchUpstream(t, upstream{name: "post", format: "json", url: srv.URL, timeout: time.Second}, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := itemIDs(items), []string{"post:p1", "post:p2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("items = %q, want %q", got, want)
+	}
+	if got := string(items[1].Value); got != `{"id":"p2","title":"b"}` {
+		t.Errorf("value = %s", got)
+	}
+}
+
+func TestUpstreamJSONNotArray(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id":"p1"}`)
+	}))
+	defer srv.Close()
+	if _, err := fetchUpstream(t, upstream{name: "post", format: "json", url: srv.URL, timeout: time.Second}, nil, nil, 0); err == nil {
+		t.Error("an object was accepted as a JSON array")
+	}
+}
+
+func TestUpstreamNDJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "{\"id\":\"u1\"}\n\n  {\"id\":\"u2\"}  \n{\"id\":\"u3\"}")
+	}))
+	defer srv.Close()
+	u := upstream{name: "user", format: "ndjson", url: srv.URL, timeout: time.Second}
+	items, err := fetchUpstream(t, u, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := itemIDs(items), []string{"user:u1", "user:u2", "user:u3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("items = %q, want %q", got, want)
+	}
+	// A resumed source skips the items it already sent.
+	items, err = fetchUpstream(t, u, nil, nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := itemIDs(items), []string{"user:u3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("items from offset 2 = %q, want %q", got, want)
+	}
+}
+
+// Items are sent as they are decoded, before the upstream has finished.
+func TestUpstreamNDJSONStreams(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"id":"u1"}`)
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprintln(w, `{"id":"u2"}`)
+	}))
+	defer srv.Close()
+	defer close(release)
+	ch := make(chan Item[json.RawMessage])
+	go (upstream{name: "user", format: "ndjson", url: srv.URL, timeout: time.Second}).source(nil, nil).Run(t.Context(), 0, ch)
+	select {
+	case it := <-ch:
+		if it.ID != "u1" {
+			t.Errorf("first item = %s", it.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no item before the upstream finished")
+	}
+}
+
+func TestUpstreamMultipart(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Accept"); got != "multipart/mixed" {
+			t.Errorf("Accept = %q", got)
+		}
+		mw := multipart.NewWriter(w)
+		w.Header().Set("Content-Type", mw.FormDataContentType())
+		for _, body := range []string{`{"type":"comment","c1":{"id":"c1"}}`, `{"type":"comment","c2":{"id":"c2"}}`} {
+			p, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+			io.WriteString(p, body)
+		}
+		mw.Close()
+	}))
+	defer srv.Close()
+	items, err := fetchUpstream(t, upstream{name: "comment", format: "multipart", url: srv.URL, timeout: time.Second}, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, len(items))
+	for i, it := range items {
+		got[i] = string(it.Value)
+	}
+	if want := []string{`{"type":"comment","c1":{"id":"c1"}}`, `{"type":"comment","c2":{"id":"c2"}}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parts = %q, want %q", got, want)
+	}
+}
+
+func TestUpstreamMultipartWrongType(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[]`)
+	}))
+	defer srv.Close()
+	if _, err := fetchUpstream(t, upstream{name: "comment", format: "multipart", url: srv.URL, timeout: time.Second}, nil, nil, 0); err == nil {
+		t.Error("a JSON response was accepted as multipart")
+	}
+}
+
+func TestUpstreamStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	_, err := fetchUpstream(t, upstream{name: "post", format: "json", url: srv.URL, timeout: time.Second}, nil, nil, 0)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("err = %v, want the upstream's status", err)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "[")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	start := time.Now()
+	_, err := fetchUpstream(t, upstream{name: "post", format: "json", url: srv.URL, timeout: 50 * time.Millisecond}, nil, nil, 0)
+	if err == nil {
+		t.Fatal("a stalled upstream did not time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("timed out after %s", elapsed)
+	}
+}
+
+func TestUpstreamForwardHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		fmt.Fprint(w, `[]`)
+	}))
+	defer srv.Close()
+	incoming := http.Header{
+		"Authorization":   {"Bearer t"},
+		"X-Tenant":        {"a", "b"},
+		"Cookie":          {"session=1"},
+		"X-Stream-Budget": {"1s"},
+	}
+	if _, err := fetchUpstream(t, upstream{name: "post", format: "json", url: srv.URL, timeout: time.Second}, incoming, []string{"Authorization", "X-Tenant"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("Authorization") != "Bearer t" || !reflect.DeepEqual(got.Values("X-Tenant"), []string{"a", "b"}) {
+		t.Errorf("forwarded headers = %v", got)
+	}
+	if got.Get("Cookie") != "" || got.Get("X-Stream-Budget") != "" {
+		t.Errorf("headers not asked for were forwarded: %v", got)
+	}
+}
+
+// An upstream post source is streamed by /stream, which then has no ETag.
+func TestStreamUpstream(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"id":"remote1","title":"from upstream"}]`)
+	}))
+	defer up.Close()
+	saved := upstreams
+	upstreams = upstreamFlags{{name: "post", format: "json", url: up.URL, timeout: time.Second}}
+	defer func() { upstreams = saved }()
+
+	srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer srv.Close()
+	// Nothing local changed since the current version, so the stream does not
+	// wait on the local sources.
+	resp, err := http.Get(fmt.Sprintf("%s/stream?since=%d", srv.URL, db.snapshot().version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), `"remote1"`) {
+		t.Errorf("stream has no upstream post: %s", body)
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		t.Errorf("ETag = %q for a stream with an upstream", etag)
+	}
+}
+
+// An upstream takes the place of the local source of the same name; others
+// are added after the local ones.
+func TestStreamSourcesUpstream(t *testing.T) {
+	saved := upstreams
+	upstreams = upstreamFlags{{name: "post", format: "json"}, {name: "tag", format: "ndjson"}}
+	defer func() { upstreams = saved }()
+	sources := streamSources(httptest.NewRequest("GET", "/stream", nil), view{snap: db.snapshot()})
+	names := make([]string, len(sources))
+	for i, src := range sources {
+		names[i] = src.Name
+	}
+	if want := []string{"post", "comment", "user", "tag"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("sources = %q, want %q", names, want)
+	}
+	if got, want := localEntities(sources), []string{"comment", "user"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("local entities = %q, want %q", got, want)
+	}
+}
+
+// A page has no more posts than its limit, even from an upstream source.
+func TestStreamUpstreamPage(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := range 5 {
+			fmt.Fprintf(w, "{\"id\":\"remote%d\"}\n", i)
+		}
+	}))
+	defer up.Close()
+	savedUpstreams, savedLatency := upstreams, emitLatency
+	upstreams = upstreamFlags{{name: "post", format: "ndjson", url: up.URL, timeout: time.Second}}
+	emitLatency = time.Millisecond
+	defer func() { upstreams, emitLatency = savedUpstreams, savedLatency }()
+
+	r := httptest.NewRequest("GET", "/stream?limit=2", nil)
+	r.Pattern = "/stream"
+	w := httptest.NewRecorder()
+	streamHandler(w, r)
+	var got []string
+	for _, p := range readParts(t, w) {
+		var body map[string]json.RawMessage
+		if json.Unmarshal(p.Body, &body) == nil && string(body["type"]) == `"post"` {
+			for id := range body {
+				if id != "type" {
+					got = append(got, id)
+				}
+			}
+		}
+	}
+	if want := []string{"remote0", "remote1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("posts = %q, want %q", got, want)
+	}
+}